@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// accessLog writes a line for each request served; it is nil if
+// access logging is disabled.
+var accessLog *log.Logger
+
+// setupAccessLog opens the access log at path, appending to it if it
+// already exists. A path of "-" logs to standard error, and an empty
+// path disables access logging.
+func setupAccessLog(path string) error {
+	switch path {
+	case "":
+		return nil
+	case "-":
+		accessLog = log.New(os.Stderr, "", log.LstdFlags)
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	accessLog = log.New(file, "", log.LstdFlags)
+	return nil
+}
+
+// A statusWriter records the status of a response written directly by
+// an endpoint, rather than returned as a Response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Flush passes flushes through, so that streaming endpoints still work
+// with access logging enabled.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// logAccess records a request that was answered with status after
+// elapsed.
+func logAccess(req *http.Request, status int, elapsed time.Duration) {
+	accessLog.Printf("remote=%s method=%s path=%q status=%d duration=%s",
+		req.RemoteAddr, req.Method, "/"+logKey(req.URL.Path[1:]), status, elapsed)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+)
+
+// hashKeys controls whether keys are replaced with a hash of the key
+// when they're logged.
+var hashKeys bool
+
+// logKey returns the form of key that should appear in logs. If
+// -hash-keys-in-logs is set, this is a truncated SHA-256 hash of the
+// key, which still allows log entries for the same key to be
+// correlated without revealing it.
+func logKey(key string) string {
+	if !hashKeys {
+		return key
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// audit controls the audit log, which records every write made to the
+// store.
+var audit = struct {
+	// logger writes audit records; it is nil if auditing is
+	// disabled.
+	logger *log.Logger
+
+	// noops controls whether writes that didn't change the
+	// stored value are recorded.
+	noops bool
+}{}
+
+// setupAudit opens the audit log at path, appending to it if it
+// already exists. An empty path disables auditing.
+func setupAudit(path string, noops bool) error {
+	audit.noops = noops
+	if path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	audit.logger = log.New(file, "", log.LstdFlags)
+	return nil
+}
+
+// auditWrite records an operation on key made by the client at
+// remote. By default, only operations that changed the store are
+// recorded; no-op writes are only recorded if the server was started
+// with -audit-noops.
+func auditWrite(remote, op, key string, changed bool) {
+	if audit.logger == nil {
+		return
+	}
+
+	if !changed && !audit.noops {
+		return
+	}
+
+	audit.logger.Printf("remote=%s op=%s key=%q changed=%t", remote, op, logKey(key), changed)
+}
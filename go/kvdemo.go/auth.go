@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// auth controls bearer token authentication.
+var auth = struct {
+	// token is the token that must be presented; if it's empty,
+	// authentication is disabled.
+	token string
+
+	// reads controls whether reads also require the token.
+	reads bool
+}{}
+
+// authorized reports whether req may proceed. If a token has been
+// configured, it must be given in an "Authorization: Bearer" header
+// for any request other than a GET or HEAD, which covers every endpoint
+// that can change the store; those require it only if reads are gated
+// too.
+func authorized(req *http.Request) bool {
+	if auth.token == "" {
+		return true
+	}
+
+	if (req.Method == "GET" || req.Method == "HEAD") && !auth.reads {
+		return true
+	}
+
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(auth.token)) == 1
+}
+
+// unauthorized returns a response for a request that wasn't
+// authorized.
+func unauthorized(w http.ResponseWriter) *Response {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="kvdemo"`)
+	return &Response{
+		Status: http.StatusUnauthorized,
+		Data:   "a valid bearer token is required",
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import "net/http"
+
+// A Store is a backend that holds the key/value pairs. The handlers go
+// through a Store for the basic operations on keys, so that backends
+// other than the JSON file can be swapped in. The more specialised
+// operations (fields, expiry, numeric keys and so on) still work on
+// the in-memory store directly; with other backends, they're refused
+// rather than silently working on an empty store.
+type Store interface {
+	// Get returns the value stored under key, and false if the key
+	// isn't present.
+	Get(key string) (Value, bool)
+
+	// Set stores value under key, returning the previous value (or
+	// nil if the key is new) and whether the value changed. It
+	// returns errStoreFull if the store's size limit would be
+	// exceeded, and errTypeMismatch if a numeric key is set to a
+	// string.
+	Set(key, value string) (*Value, bool, error)
+
+	// Delete removes key, returning false if it wasn't present.
+	Delete(key string) bool
+
+	// List returns the keys beginning with prefix, sorted. It
+	// returns errListTooLarge if the list would be larger than
+	// maxListBytes.
+	List(prefix string) ([]string, error)
+
+	// Flush writes any changes to durable storage.
+	Flush() error
+}
+
+// jsonStore is the default Store, which keeps the key/value pairs in
+// memory and writes them to the store file as a single JSON document.
+type jsonStore struct{}
+
+func (jsonStore) Get(key string) (Value, bool) {
+	return getValue(key)
+}
+
+func (jsonStore) Set(key, value string) (*Value, bool, error) {
+	return setValue(key, value)
+}
+
+func (jsonStore) Delete(key string) bool {
+	return deleteKey(key)
+}
+
+func (jsonStore) List(prefix string) ([]string, error) {
+	return listKeys(prefix)
+}
+
+func (jsonStore) Flush() error {
+	return writeStore()
+}
+
+// backend is the Store used by the handlers, and backendName the name
+// it was chosen by.
+var (
+	backend     Store = jsonStore{}
+	backendName       = "json"
+)
+
+// backends maps the names accepted by -backend to functions that open
+// a Store at the store file's path. Backends that need extra
+// dependencies register themselves from files built with a build tag.
+var backends = map[string]func(path string) (Store, error){
+	"json": func(string) (Store, error) { return jsonStore{}, nil },
+}
+
+// memoryEndpoints lists the reserved paths whose endpoints work on the
+// in-memory store directly rather than through a Store, and so aren't
+// available with other backends.
+var memoryEndpoints = []string{
+	"_diffdump",
+	"_expire/run",
+	"_expiring",
+	"_export",
+	"_getorset/",
+	"_history/",
+	"_import",
+	"_incr/",
+	"_mget",
+	"_mset",
+	"_num/",
+	"_pop/",
+	"_recent",
+	"_snapshot",
+	"_stats/prefixes",
+	"_stream",
+}
+
+// inMemory reports whether the backend is the in-memory JSON store,
+// which supports every operation.
+func inMemory() bool {
+	_, ok := backend.(jsonStore)
+	return ok
+}
+
+// unsupported is registered in place of the endpoints that don't work
+// with the backend.
+func unsupported(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	return notImplemented(req.URL.Path)
+}
+
+// notImplemented returns the response for a request that the backend
+// doesn't support.
+func notImplemented(what string) *Response {
+	return &Response{
+		Status: http.StatusNotImplemented,
+		Data:   what + " isn't supported by the " + backendName + " backend",
+	}
+}
+
+// restrictEndpoints replaces the endpoints in memoryEndpoints with
+// unsupported, for backends other than the in-memory store.
+func restrictEndpoints() {
+	for _, path := range memoryEndpoints {
+		for method := range endpoints[path] {
+			endpoints[path][method] = unsupported
+		}
+	}
+}
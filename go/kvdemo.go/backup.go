@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// backupTimeFormat is the format of the timestamp in the name of a
+// backup. It sorts in time order, and avoids colons so that the name is
+// valid everywhere.
+const backupTimeFormat = "2006-01-02T15-04-05"
+
+// backupKeep is the number of backups to keep; 0 keeps all of them.
+var backupKeep int
+
+// backupDestructive causes a backup to be written before a request
+// that replaces the whole store.
+var backupDestructive bool
+
+// backupStore writes a copy of the store next to the store file, named
+// with the current time, and returns its path. The copy is written
+// atomically. If backupKeep is set, the oldest backups beyond that
+// number are removed.
+func backupStore() (string, error) {
+	out, err := json.Marshal(snapshot())
+	if err != nil {
+		return "", err
+	}
+
+	return writeBackup(out)
+}
+
+// destructiveBackup writes a backup of the store before it's replaced,
+// if -backup-before-destructive is set, and returns its path. No backup
+// is written, and the path is empty, if the store is empty.
+func destructiveBackup() (string, error) {
+	if !backupDestructive {
+		return "", nil
+	}
+
+	values := snapshot()
+	if len(values) == 0 {
+		return "", nil
+	}
+
+	out, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+
+	return writeBackup(out)
+}
+
+// writeBackup writes out as a backup of the store, returning its path.
+func writeBackup(out []byte) (string, error) {
+	if !persistent() {
+		return "", errors.New("the store is only kept in memory, so there's nowhere to write backups")
+	}
+
+	path := store.file + "." + time.Now().Format(backupTimeFormat)
+	err := writeFileAtomic(path, out)
+	if err != nil {
+		return "", err
+	}
+
+	return path, pruneBackups()
+}
+
+// backupEvery writes a backup of the store every interval until done
+// is closed. A backup is skipped if the store hasn't changed since the
+// last one, so that idle periods don't fill the disk with identical
+// copies.
+func backupEvery(interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	var last [sha256.Size]byte
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		out, err := json.Marshal(snapshot())
+		if err != nil {
+			log.Printf("failed to back up store: %v", err)
+			continue
+		}
+
+		sum := sha256.Sum256(out)
+		if sum == last {
+			continue
+		}
+
+		path, err := writeBackup(out)
+		if err != nil {
+			log.Printf("failed to back up store: %v", err)
+			continue
+		}
+
+		last = sum
+		log.Printf("backed up store to %s", path)
+	}
+}
+
+// pruneBackups removes all but the newest backupKeep backups.
+func pruneBackups() error {
+	if backupKeep <= 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(store.file + ".????-??-??T??-??-??")
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(backups)
+	for len(backups) > backupKeep {
+		err = os.Remove(backups[0])
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// backup writes a backup of the store, returning its path.
+func backup(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	path, err := backupStore()
+	if err != nil {
+		return &Response{
+			Status: http.StatusInternalServerError,
+			Data:   "server encountered an error writing the backup: " + err.Error(),
+		}
+	}
+
+	return &Response{
+		Status: http.StatusOK,
+		Data:   map[string]string{"path": path},
+	}
+}
@@ -0,0 +1,183 @@
+//go:build bolt
+// +build bolt
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// This file is only built with the bolt build tag, as it depends on
+// go.etcd.io/bbolt:
+//
+//	go build -tags bolt
+
+func init() {
+	backends["bolt"] = openBolt
+}
+
+// boltBucket is the bucket holding the key/value pairs.
+var boltBucket = []byte("kv")
+
+// boltStore is a Store backed by a BoltDB file. Each key's Value is
+// stored as its own JSON document, so a change only rewrites that key
+// rather than the whole store. Every change is committed in its own
+// transaction.
+//
+// Only the Store operations are supported: the endpoints and flags
+// that work on the in-memory store are refused when this backend is
+// used (see memoryEndpoints), and the metrics only count requests.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// openBolt opens the BoltDB file at path, creating it if needed.
+func openBolt(path string) (Store, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+// boltGet decodes the unexpired value stored under key in b, if there
+// is one.
+func boltGet(b *bolt.Bucket, key []byte) (*Value, error) {
+	data := b.Get(key)
+	if data == nil {
+		return nil, nil
+	}
+
+	v := &Value{}
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.expired(time.Now().Unix()) {
+		return nil, nil
+	}
+	return v, nil
+}
+
+func (bs *boltStore) Get(key string) (Value, bool) {
+	var v *Value
+	bs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		v, err = boltGet(tx.Bucket(boltBucket), []byte(key))
+		return err
+	})
+
+	if v == nil {
+		return Value{}, false
+	}
+	return *v, true
+}
+
+func (bs *boltStore) Set(key, value string) (*Value, bool, error) {
+	var prev *Value
+	var changed bool
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		v, err := boltGet(b, []byte(key))
+		if err != nil {
+			return err
+		}
+
+		if v == nil {
+			v = &Value{}
+		} else {
+			c := v.clone()
+			prev = &c
+		}
+
+		if v.Type == typeNumber {
+			if _, err = parseNumber(value); err != nil {
+				return errTypeMismatch
+			}
+		}
+
+		if value != v.Value {
+			v.remember()
+		}
+
+		changed = v.update(value)
+		if !changed {
+			return nil
+		}
+		capVersion(key, v)
+
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+
+	if err != nil {
+		return prev, false, err
+	}
+	return prev, changed, nil
+}
+
+func (bs *boltStore) Delete(key string) bool {
+	var deleted bool
+	bs.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		v, err := boltGet(b, []byte(key))
+		if err != nil || v == nil {
+			return err
+		}
+
+		deleted = true
+		return b.Delete([]byte(key))
+	})
+	return deleted
+}
+
+func (bs *boltStore) List(prefix string) ([]string, error) {
+	keys := []string{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		now := time.Now().Unix()
+		size := 2
+		c := tx.Bucket(boltBucket).Cursor()
+		p := []byte(prefix)
+		for k, data := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, data = c.Next() {
+			var v Value
+			if json.Unmarshal(data, &v) == nil && !v.expired(now) {
+				size += listSize(string(k))
+				if maxListBytes > 0 && size > maxListBytes {
+					return errListTooLarge
+				}
+				keys = append(keys, string(k))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// BoltDB keeps keys in byte order, so they're already sorted.
+	return keys, nil
+}
+
+// Flush does nothing, as each change is committed to disk in its own
+// transaction.
+func (bs *boltStore) Flush() error {
+	return nil
+}
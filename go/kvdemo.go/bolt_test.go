@@ -0,0 +1,161 @@
+//go:build bolt
+// +build bolt
+
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// openTestBolt opens a bolt backend in a temporary directory.
+func openTestBolt(t *testing.T) *boltStore {
+	s, err := openBolt(filepath.Join(t.TempDir(), "store.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs := s.(*boltStore)
+	t.Cleanup(func() { bs.db.Close() })
+	return bs
+}
+
+// putRaw stores v under key directly, for values that can't be made
+// through the Store interface.
+func putRaw(t *testing.T, bs *boltStore, key string, v Value) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltSetGetDelete(t *testing.T) {
+	bs := openTestBolt(t)
+
+	prev, changed, err := bs.Set("key", "one")
+	if err != nil || !changed || prev != nil {
+		t.Fatalf("first set: prev %v, changed %t, err %v", prev, changed, err)
+	}
+
+	prev, changed, err = bs.Set("key", "one")
+	if err != nil || changed || prev == nil || prev.Value != "one" {
+		t.Fatalf("unchanged set: prev %v, changed %t, err %v", prev, changed, err)
+	}
+
+	_, changed, err = bs.Set("key", "two")
+	if err != nil || !changed {
+		t.Fatalf("second set: changed %t, err %v", changed, err)
+	}
+
+	v, ok := bs.Get("key")
+	if !ok || v.Value != "two" || v.Version != 2 {
+		t.Fatalf("get returned %+v, %t; want two at version 2", v, ok)
+	}
+
+	if !bs.Delete("key") {
+		t.Fatal("delete of an existing key returned false")
+	}
+
+	if bs.Delete("key") {
+		t.Fatal("delete of a missing key returned true")
+	}
+
+	if _, ok = bs.Get("key"); ok {
+		t.Fatal("deleted key is still present")
+	}
+}
+
+func TestBoltList(t *testing.T) {
+	bs := openTestBolt(t)
+	for _, key := range []string{"b/2", "a/1", "b/1", "c"} {
+		if _, _, err := bs.Set(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := bs.List("b/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b/1", "b/2"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("List(b/) = %v, want %v", keys, want)
+	}
+
+	keys, err = bs.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a/1", "b/1", "b/2", "c"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("List() = %v, want %v", keys, want)
+	}
+
+	defer func() { maxListBytes = 0 }()
+	maxListBytes = 10
+	if _, err = bs.List(""); err != errListTooLarge {
+		t.Errorf("List() over -max-list-bytes returned %v, want errListTooLarge", err)
+	}
+}
+
+func TestBoltExpiry(t *testing.T) {
+	bs := openTestBolt(t)
+	putRaw(t, bs, "expired", Value{Version: 1, Value: "old", ExpiresAt: time.Now().Unix() - 1})
+	putRaw(t, bs, "live", Value{Version: 1, Value: "new", ExpiresAt: time.Now().Unix() + 60})
+
+	if _, ok := bs.Get("expired"); ok {
+		t.Error("expired key is present")
+	}
+
+	if _, ok := bs.Get("live"); !ok {
+		t.Error("unexpired key is missing")
+	}
+
+	keys, err := bs.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"live"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("List() = %v, want %v", keys, want)
+	}
+
+	if bs.Delete("expired") {
+		t.Error("delete of an expired key returned true")
+	}
+
+	// Setting an expired key starts it afresh.
+	prev, _, err := bs.Set("expired", "again")
+	if err != nil || prev != nil {
+		t.Errorf("set of an expired key: prev %v, err %v", prev, err)
+	}
+}
+
+func TestBoltTypeMismatch(t *testing.T) {
+	bs := openTestBolt(t)
+	putRaw(t, bs, "n", Value{Version: 1, Value: "1", Type: typeNumber})
+
+	_, changed, err := bs.Set("n", "abc")
+	if err != errTypeMismatch || changed {
+		t.Fatalf("setting a numeric key to a string: changed %t, err %v", changed, err)
+	}
+
+	_, changed, err = bs.Set("n", "2")
+	if err != nil || !changed {
+		t.Fatalf("setting a numeric key to a number: changed %t, err %v", changed, err)
+	}
+
+	v, _ := bs.Get("n")
+	if v.Value != "2" || v.Type != typeNumber {
+		t.Errorf("numeric key is %+v", v)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// maxClockSkew is how far in the future an update timestamp may be
+// before it's considered invalid.
+const maxClockSkew = 24 * time.Hour
+
+// verifyValue checks the invariants that hold for every value written
+// by the server, returning a description of each one that v violates.
+// A field of a value can't have fields of its own.
+func verifyValue(name string, v *Value, now int64, field bool) []string {
+	var problems []string
+	if v == nil {
+		return []string{name + ": value is null"}
+	}
+
+	if v.Version < 0 {
+		problems = append(problems, fmt.Sprintf("%s: negative version %d", name, v.Version))
+	}
+
+	if v.Version == 0 && v.Value != "" {
+		problems = append(problems, name+": value has never been written but isn't empty")
+	}
+
+	if tooLarge(v.Value) {
+		problems = append(problems, fmt.Sprintf("%s: values may be at most %d bytes", name, maxValueSize))
+	}
+
+	if v.Updated < 0 {
+		problems = append(problems, fmt.Sprintf("%s: negative update time %d", name, v.Updated))
+	} else if v.Updated > now+int64(maxClockSkew.Seconds()) {
+		problems = append(problems, fmt.Sprintf("%s: update time %d is in the future", name, v.Updated))
+	}
+
+	if v.ExpiresAt < 0 {
+		problems = append(problems, fmt.Sprintf("%s: negative expiry time %d", name, v.ExpiresAt))
+	}
+
+	switch v.Type {
+	case "":
+	case typeNumber:
+		if _, err := parseNumber(v.Value); err != nil {
+			problems = append(problems, name+": numeric key holds a non-numeric value")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("%s: unknown type %q", name, v.Type))
+	}
+
+	if field && len(v.Fields) > 0 {
+		problems = append(problems, name+": field has fields of its own")
+	} else if v.Type == typeNumber && len(v.Fields) > 0 {
+		problems = append(problems, name+": numeric key has fields")
+	}
+
+	for f, fv := range v.Fields {
+		problems = append(problems, verifyValue(name+"/"+f, fv, now, true)...)
+	}
+
+	return problems
+}
+
+// verifyValues checks every key and value in values, returning the
+// problems found in key order. It's used for the store file by -check
+// and for data from outside the server by -seed and /_import, so that a
+// store file that passes -check can always be imported.
+func verifyValues(values map[string]*Value) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	now := time.Now().Unix()
+	for _, key := range keys {
+		name := fmt.Sprintf("key %q", key)
+		if err := validateKey(key); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+		problems = append(problems, verifyValue(name, values[key], now, false)...)
+	}
+
+	return problems
+}
+
+// checkValues returns an error describing the first problem
+// verifyValues finds in values, or nil if every entry could be stored.
+func checkValues(values map[string]*Value) error {
+	if problems := verifyValues(values); len(problems) > 0 {
+		return errors.New(problems[0])
+	}
+	return nil
+}
+
+// checkStoreFile loads the store file at path without serving it and
+// prints a report of any problems with it. It returns false if the
+// file couldn't be loaded or has problems.
+func checkStoreFile(path string) bool {
+	in, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		return false
+	}
+
+	var values map[string]*Value
+	err = json.Unmarshal(in, &values)
+	if err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		return false
+	}
+
+	problems := verifyValues(values)
+	fmt.Printf("%s: %d keys, %d problems\n", path, len(values), len(problems))
+	for _, problem := range problems {
+		fmt.Println("\t" + problem)
+	}
+
+	return len(problems) == 0
+}
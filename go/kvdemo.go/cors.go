@@ -0,0 +1,22 @@
+package main
+
+import "net/http"
+
+// corsOrigin is the origin that browsers are allowed to make requests
+// from; if it's empty, no CORS headers are sent.
+var corsOrigin string
+
+// setCORS adds the CORS headers allowing requests from corsOrigin to
+// the response. It must be called before the status is written.
+func setCORS(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", corsOrigin)
+	h.Set("Access-Control-Allow-Methods", "GET, POST, DELETE")
+	h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match, If-Modified-Since, X-Pretty")
+}
+
+// preflight reports whether req is a CORS preflight request that should
+// be answered by the server rather than an endpoint.
+func preflight(req *http.Request) bool {
+	return corsOrigin != "" && req.Method == "OPTIONS"
+}
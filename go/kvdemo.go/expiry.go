@@ -0,0 +1,218 @@
+package main
+
+import (
+	"container/heap"
+	"log"
+	"sort"
+	"time"
+)
+
+// expired reports whether v has expired as of now.
+func (v *Value) expired(now int64) bool {
+	return v.ExpiresAt != 0 && v.ExpiresAt <= now
+}
+
+// live returns the value stored under key if it's present and hasn't
+// expired. An expired value is removed from the store. The caller must
+// hold the store lock.
+func live(key string) (*Value, bool) {
+	v, ok := store.values[key]
+	if !ok {
+		return nil, false
+	}
+
+	if v.expired(time.Now().Unix()) {
+		dropValue(key)
+		return nil, false
+	}
+	return v, true
+}
+
+// setExpiry sets the time at which key expires, which must already
+// exist; 0 means it never expires. It returns true if the expiry time
+// was changed.
+func setExpiry(key string, expiresAt int64) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	v, ok := live(key)
+	if !ok || v.ExpiresAt == expiresAt {
+		return false
+	}
+
+	v.ExpiresAt = expiresAt
+	indexExpiry(key, expiresAt)
+	notify(key, v)
+	return true
+}
+
+// An Expiring key is one that will expire soon. It is exported so that
+// it may be serialised by the JSON package.
+type Expiring struct {
+	Key       string `json:"key"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// expiringKeys returns the keys that will expire in the next within
+// seconds, soonest first. Keys that have already expired, and keys
+// without an expiry time, aren't included.
+func expiringKeys(within int64) []Expiring {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	now := time.Now().Unix()
+	keys := []Expiring{}
+	for key, v := range store.values {
+		if v.ExpiresAt != 0 && !v.expired(now) && v.ExpiresAt <= now+within {
+			keys = append(keys, Expiring{Key: key, ExpiresAt: v.ExpiresAt})
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ExpiresAt != keys[j].ExpiresAt {
+			return keys[i].ExpiresAt < keys[j].ExpiresAt
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
+
+// An expiryEntry records when a key expires in the expiry index.
+type expiryEntry struct {
+	key   string
+	at    int64
+	index int // The entry's position in the heap.
+}
+
+// expiryHeap orders keys by the time they expire, soonest first. It
+// implements heap.Interface.
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at < h[j].at }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*expiryEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// expiries indexes the keys that have an expiry time, so that expired
+// keys can be found without scanning the store. It's guarded by the
+// store lock.
+var expiries = struct {
+	heap    expiryHeap
+	entries map[string]*expiryEntry
+}{
+	entries: map[string]*expiryEntry{},
+}
+
+// indexExpiry records that key expires at the Unix time at; 0 removes
+// it from the index. The caller must hold the store lock.
+func indexExpiry(key string, at int64) {
+	e, ok := expiries.entries[key]
+	switch {
+	case at == 0:
+		unindexExpiry(key)
+	case ok:
+		e.at = at
+		heap.Fix(&expiries.heap, e.index)
+	default:
+		e = &expiryEntry{key: key, at: at}
+		heap.Push(&expiries.heap, e)
+		expiries.entries[key] = e
+	}
+}
+
+// unindexExpiry removes key from the expiry index. The caller must
+// hold the store lock.
+func unindexExpiry(key string) {
+	if e, ok := expiries.entries[key]; ok {
+		heap.Remove(&expiries.heap, e.index)
+		delete(expiries.entries, key)
+	}
+}
+
+// indexExpiries rebuilds the expiry index from the store, after it's
+// been loaded.
+func indexExpiries() {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	expiries.heap = nil
+	expiries.entries = map[string]*expiryEntry{}
+	for key, v := range store.values {
+		indexExpiry(key, v.ExpiresAt)
+	}
+}
+
+// expireDue removes up to limit expired keys from the store, soonest
+// expiring first, returning the number removed; a limit of 0 removes
+// every expired key. The expired keys are found from the expiry index,
+// so the work done depends on the number of keys removed rather than
+// the size of the store.
+func expireDue(limit int) int {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	removed := 0
+	now := time.Now().Unix()
+	for len(expiries.heap) > 0 && (limit <= 0 || removed < limit) {
+		e := expiries.heap[0]
+		if e.at > now {
+			break
+		}
+
+		unindexExpiry(e.key)
+		if v, ok := store.values[e.key]; ok && v.expired(now) {
+			dropValue(e.key)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// removeExpired removes every expired key from the store, returning
+// the number of keys removed.
+func removeExpired() int {
+	return expireDue(0)
+}
+
+// sweepBatch is the most expired keys removed by each sweep; 0 means
+// every expired key is removed.
+var sweepBatch int
+
+// sweep removes expired keys from the store every interval, writing
+// the store to disk if any were removed. With -sweep-batch, each sweep
+// removes at most that many keys, so the store lock is only held for a
+// bounded time, and a backlog of expired keys is cleared over several
+// sweeps. Expired keys are already treated as absent when they're
+// looked up, as getValue and live check the expiry time; sweeping
+// reclaims their memory and keeps them out of the metrics.
+func sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		if expireDue(sweepBatch) == 0 {
+			continue
+		}
+
+		err := persist()
+		if err != nil {
+			log.Printf("failed to write store after removing expired keys: %v", err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gzipResponses enables the compression of responses for clients that
+// accept it.
+var gzipResponses bool
+
+// gzipMinSize is the size below which responses aren't compressed, as
+// compressing them would save little or even make them larger.
+const gzipMinSize = 1024
+
+// acceptsGzip reports whether the client that sent req accepts gzipped
+// responses.
+func acceptsGzip(req *http.Request) bool {
+	for _, enc := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			q, err := strconv.ParseFloat(param[2:], 64)
+			if err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// A gzipWriter compresses what's written to it once it has seen at
+// least gzipMinSize bytes. Until then, the output is held back, so
+// that a short response can be written uncompressed when the writer
+// is closed. The Content-Encoding header is set on w before anything
+// compressed is written to out.
+type gzipWriter struct {
+	w   http.ResponseWriter
+	out io.Writer
+	buf []byte
+	gz  *gzip.Writer
+}
+
+func (gw *gzipWriter) Write(p []byte) (int, error) {
+	if gw.gz != nil {
+		return gw.gz.Write(p)
+	}
+
+	gw.buf = append(gw.buf, p...)
+	if len(gw.buf) < gzipMinSize {
+		return len(p), nil
+	}
+
+	gw.w.Header().Set("Content-Encoding", "gzip")
+	gw.w.Header().Del("Content-Length")
+	gw.gz = gzip.NewWriter(gw.out)
+	_, err := gw.gz.Write(gw.buf)
+	gw.buf = nil
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close finishes the response, writing out anything held back.
+func (gw *gzipWriter) Close() error {
+	if gw.gz != nil {
+		return gw.gz.Close()
+	}
+
+	_, err := gw.out.Write(gw.buf)
+	return err
+}
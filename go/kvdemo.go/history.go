@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// historyKeep is the number of previous versions kept for each key; 0
+// disables history.
+var historyKeep int
+
+// historyDepth is the number of versions returned by /_history when
+// the request doesn't give a depth.
+const historyDepth = 10
+
+// A HistoryEntry is a previous version of a key's value. It is exported
+// so that it may be serialised by the JSON package.
+type HistoryEntry struct {
+	Updated int64
+	Version int
+	Value   string
+}
+
+// remember records the current version of v in its history before it
+// is replaced, dropping the oldest versions beyond historyKeep. A value
+// that has never been written has no version to remember.
+func (v *Value) remember() {
+	if historyKeep <= 0 || v.Version == 0 {
+		v.History = nil
+		return
+	}
+
+	v.History = append(v.History, HistoryEntry{
+		Updated: v.Updated,
+		Version: v.Version,
+		Value:   v.Value,
+	})
+
+	if over := len(v.History) - historyKeep; over > 0 {
+		v.History = append([]HistoryEntry(nil), v.History[over:]...)
+	}
+}
+
+// public returns v as it's served to clients. The history is only
+// kept in the store file; clients read old versions by their version
+// number, or a few at a time from /_history.
+func (v Value) public() Value {
+	v.History = nil
+	return v
+}
+
+// recent returns up to depth of the versions of v that are retained,
+// newest first, starting with v itself. It also returns the number of
+// versions retained.
+func (v Value) recent(depth int) ([]HistoryEntry, int) {
+	total := len(v.History) + 1
+	if depth > total {
+		depth = total
+	}
+
+	versions := make([]HistoryEntry, 0, depth)
+	versions = append(versions, HistoryEntry{Updated: v.Updated, Version: v.Version, Value: v.Value})
+	for i := len(v.History) - 1; i >= 0 && len(versions) < depth; i-- {
+		versions = append(versions, v.History[i])
+	}
+	return versions, total
+}
+
+// history returns the most recent versions of key, newest first,
+// along with the number of versions retained. The depth query
+// parameter sets how many are returned, which defaults to
+// historyDepth; it doesn't change how many are retained, which is set
+// by -history. A missing key results in an HTTP 404, and an invalid
+// depth in an HTTP Bad Request.
+func history(w http.ResponseWriter, req *http.Request, key string) *Response {
+	depth := historyDepth
+	if param := req.URL.Query().Get("depth"); param != "" {
+		var err error
+		depth, err = strconv.Atoi(param)
+		if err != nil || depth <= 0 {
+			return &Response{
+				Status: http.StatusBadRequest,
+				Data:   "depth must be a positive number of versions",
+			}
+		}
+	}
+
+	v, ok := getValue(key)
+	countGet(ok)
+	if !ok {
+		return &Response{
+			Status: http.StatusNotFound,
+			Data:   fmt.Sprintf("key '%s' doesn't exist in the store", key),
+		}
+	}
+
+	versions, total := v.recent(depth)
+	return &Response{
+		Status: http.StatusOK,
+		Data: map[string]interface{}{
+			"total":    total,
+			"versions": versions,
+		},
+	}
+}
+
+// atVersion returns version n of v, which is either v itself or one of
+// the versions in its history. It returns false if that version isn't
+// retained.
+func (v Value) atVersion(n int) (Value, bool) {
+	if v.Version == n {
+		return v, true
+	}
+
+	for i := len(v.History) - 1; i >= 0; i-- {
+		h := v.History[i]
+		if h.Version == n {
+			return Value{Updated: h.Updated, Version: h.Version, Value: h.Value, Type: v.Type}, true
+		}
+	}
+	return Value{}, false
+}
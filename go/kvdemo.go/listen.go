@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// listenUnix listens on a Unix domain socket at path. A stale socket
+// left behind by a previous run is removed first, but a socket that is
+// still being served on is left alone. The socket is only accessible
+// to its owner and group.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, 0660)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// shutdownOnSignal shuts srv down when the process is interrupted or
+// terminated, waiting up to timeout for in-flight requests to finish,
+// and then writes the store to disk. Shutting the server down closes
+// its listeners, which removes any Unix socket file. The returned
+// channel is closed once the store has been written; if it can't be
+// written, the process exits with an error instead.
+func shutdownOnSignal(srv *http.Server, timeout time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	srv.RegisterOnShutdown(unsubscribeAll)
+
+	go func() {
+		sig := <-sigs
+		log.Printf("received %v, shutting down", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		err := srv.Shutdown(ctx)
+		if err != nil {
+			log.Printf("failed to shut down cleanly: %v", err)
+		}
+
+		n, err := flushStore()
+		if err != nil {
+			log.Fatalf("failed to write store on shutdown: %v", err)
+		}
+
+		if persistent() {
+			log.Printf("flushed %d keys to %s", n, store.file)
+		}
+		close(done)
+	}()
+
+	return done
+}
+
+// checkServe exits if serving ended with an error other than the
+// server being shut down.
+func checkServe(err error) {
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// loadLog controls how much is logged about the store when it's loaded
+// at startup: "quiet" logs nothing, "summary" logs the number of keys,
+// the size of the file, the range of update times and how long loading
+// took, and "verbose" adds a breakdown of the kinds of keys loaded.
+var loadLog = "summary"
+
+// logLoad logs a summary of the store loaded from its file, which was
+// size bytes long and took took to read and decode. If the file didn't
+// exist, size is -1. The caller must make sure nothing else is using
+// the store.
+func logLoad(size int64, took time.Duration) {
+	if loadLog == "quiet" {
+		return
+	}
+
+	if size < 0 {
+		log.Printf("no store file at %s; starting with an empty store", store.file)
+		return
+	}
+
+	var oldest, newest int64
+	var numeric, fielded, expiring int
+	for _, v := range store.values {
+		if oldest == 0 || v.Updated < oldest {
+			oldest = v.Updated
+		}
+		if v.Updated > newest {
+			newest = v.Updated
+		}
+
+		if v.Type == typeNumber {
+			numeric++
+		}
+		if len(v.Fields) > 0 {
+			fielded++
+		}
+		if v.ExpiresAt != 0 {
+			expiring++
+		}
+	}
+
+	updates := "no updates"
+	if len(store.values) > 0 {
+		updates = fmt.Sprintf("updates from %s to %s", loadTime(oldest), loadTime(newest))
+	}
+
+	log.Printf("loaded %d keys (%d bytes) from %s in %v; %s",
+		len(store.values), size, store.file, took.Round(time.Microsecond), updates)
+	if loadLog == "verbose" {
+		log.Printf("loaded %d numeric keys, %d keys with fields and %d expiring keys",
+			numeric, fielded, expiring)
+	}
+}
+
+// loadTime formats a Unix timestamp from the store for the load
+// summary.
+func loadTime(t int64) string {
+	return time.Unix(t, 0).UTC().Format(time.RFC3339)
+}
@@ -1,39 +1,376 @@
 // kvdemo is a simple key-value store with an HTTP/JSON UI.
 //
 // To add a key to the store, POST a request to /<keyname> with a
-// JSON body containing {'value': <value>}. To retrieve a key, send
-// a GET request to /<keyname>. GETting the root will return some
-// metrics for the server.
+// JSON body containing {'value': <value>}. Adding a 'field' to the
+// body stores the value as a named field of the key instead; a key's
+// fields are versioned independently. Adding a 'ttl' (in seconds) to
+// the body makes the key expire after that long, and adding an
+// 'expires_at' RFC3339 time makes it expire at that time. To retrieve
+// a key, send a GET request to /<keyname>, and to remove it, send a
+// DELETE request to /<keyname>. GETting the root will return some
+// metrics for the server, which are also available in the Prometheus
+// format from /_metrics. POSTing to /_pop/<keyname> retrieves a key and
+// removes it from the store in one step, and POSTing a default value
+// to /_getorset/<keyname> retrieves a key, creating it with the default
+// if it doesn't exist. GETting /_keys lists the keys in the store,
+// optionally limited to those beginning with the prefix query
+// parameter. GETting /_export downloads the whole store, and POSTing
+// such a download to /_import merges it into the store.
 //
-// The store is persisted to disk as a JSON file.
+// Keys may not be empty, begin with an underscore (paths beginning with
+// an underscore are reserved for the server's endpoints) or contain
+// control characters, and may be at most 1024 bytes long unless the
+// -max-key-length flag says otherwise.
+//
+// Numeric keys are managed through /_num/<keyname>: a GET returns the
+// value as a JSON number, and a POST with {'op': <op>, 'operand': <n>}
+// atomically applies one of the set, add, sub, min and max operations.
+//
+// The store is persisted to disk as a JSON file. It may be seeded at
+// startup from another JSON file (or standard input) with the -seed
+// flag.
 package main
 
 import (
 	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // A Response contains the HTTP status code and result of an endpoint. It
 // is exported so that it may be serialised by the JSON package.
+//
+// Endpoints that mutate the store report the number of keys they
+// changed in Affected; it is omitted from read-only responses.
 type Response struct {
-	Status int         `json:"status"`
-	Data   interface{} `json:"data"`
+	Status   int         `json:"status"`
+	Data     interface{} `json:"data"`
+	Affected *int        `json:"affected,omitempty"`
+}
+
+// compact disables the indentation of responses.
+var compact bool
+
+// noopNoContent causes writes that don't change the store to be
+// answered with an HTTP No Content.
+var noopNoContent bool
+
+// rejectGetBody causes GET requests with a body to be rejected.
+var rejectGetBody bool
+
+// maxDrain is the most that will be read from the body of a GET
+// request to discard it; if there's more, the connection is closed
+// rather than reused.
+const maxDrain = 64 << 10
+
+// defaultContentType is the content type of downloaded values.
+var defaultContentType = "application/octet-stream"
+
+// prefixDelim is the default delimiter that ends a key's prefix.
+var prefixDelim = ":"
+
+// reportEmpty causes the index to flag an empty store.
+var reportEmpty bool
+
+// started records when the server was started.
+var started time.Time
+
+// affected returns a pointer to n suitable for use as a Response's
+// Affected field.
+func affected(n int) *int {
+	return &n
+}
+
+// A precondition is what the If-Match header of a write expects of the
+// key being written.
+type precondition struct {
+	// version and epoch are the version the key is expected to be
+	// at; a plain version number is taken to be from epoch 0.
+	version, epoch int
+
+	// tag is the ETag the key is expected to have, quoted as etag
+	// returns it, if the header held a full ETag rather than just a
+	// version. The whole tag has to match, so a change to a field,
+	// the expiry time or the filename fails the precondition even
+	// though it leaves the version alone.
+	tag string
+}
+
+// ifMatch parses the request's If-Match header, which holds the
+// version a write expects the key to be at, either as a number or as
+// an ETag from a read of the key. A tag that's only a version, such as
+// v3 or e1.v3, is compared by version alone; any other ETag has to
+// match the key's current one. A plain number is taken to be from
+// epoch 0, so it never matches a key whose version has been reset. It
+// returns false if the header isn't present.
+func ifMatch(req *http.Request) (precondition, bool, error) {
+	header := req.Header.Get("If-Match")
+	if header == "" {
+		return precondition{}, false, nil
+	}
+
+	bad := errors.New("If-Match must hold a version number or ETag")
+	tag := strings.Trim(header, `"`)
+	if version, err := strconv.Atoi(tag); err == nil {
+		if version < 0 {
+			return precondition{}, false, bad
+		}
+		return precondition{version: version}, true, nil
+	}
+
+	// An ETag is v<version>, prefixed with "e<epoch>." once the
+	// version has been reset, and possibly followed by more.
+	want := precondition{tag: `"` + tag + `"`}
+	rest := tag
+	if strings.HasPrefix(rest, "e") {
+		i := strings.Index(rest, ".")
+		if i < 0 {
+			return precondition{}, false, bad
+		}
+
+		var err error
+		want.epoch, err = strconv.Atoi(rest[1:i])
+		if err != nil || want.epoch < 0 {
+			return precondition{}, false, bad
+		}
+		rest = rest[i+1:]
+	}
+
+	if !strings.HasPrefix(rest, "v") {
+		return precondition{}, false, bad
+	}
+	rest = rest[1:]
+	if i := strings.IndexAny(rest, ".-"); i >= 0 {
+		rest = rest[:i]
+	} else {
+		want.tag = ""
+	}
+
+	var err error
+	want.version, err = strconv.Atoi(rest)
+	if err != nil || want.version < 0 {
+		return precondition{}, false, bad
+	}
+	return want, true, nil
+}
+
+// unmet describes why a key didn't meet the precondition.
+func (want precondition) unmet() string {
+	if want.tag != "" {
+		return "no longer has the ETag " + want.tag
+	}
+	return fmt.Sprintf("isn't at version %d", want.version)
+}
+
+// storeFull returns the response for a write that was rejected because
+// the store is full.
+func storeFull() *Response {
+	return &Response{
+		Status: http.StatusInsufficientStorage,
+		Data:   "the store is full; no more data may be written to it",
+	}
+}
+
+// maxValueSize is the largest value, in bytes, that may be written to
+// a key; 0 means there's no limit.
+var maxValueSize int64
+
+// tooLarge reports whether value is larger than maxValueSize.
+func tooLarge(value string) bool {
+	return maxValueSize > 0 && int64(len(value)) > maxValueSize
+}
+
+// valueTooLarge returns the response for a write whose value is larger
+// than maxValueSize.
+func valueTooLarge() *Response {
+	return &Response{
+		Status: http.StatusRequestEntityTooLarge,
+		Data:   fmt.Sprintf("values may be at most %d bytes", maxValueSize),
+	}
+}
+
+// maxUploadSize returns the largest request body that may hold a value
+// of maxValueSize bytes. JSON escaping can take up to six bytes per
+// byte of the value, and some room is left for the rest of the body.
+func maxUploadSize() int64 {
+	return 6*maxValueSize + 4096
+}
+
+// maxBodySize is the largest request body, in bytes, that will be
+// read; 0 means the limit follows from maxValueSize.
+var maxBodySize int64
+
+// bulkEndpoints lists the endpoints whose request bodies hold many
+// keys or values. Their bodies are only limited by -max-body-size.
+var bulkEndpoints = map[string]bool{
+	"_diffdump": true,
+	"_import":   true,
+	"_mget":     true,
+	"_mset":     true,
+	"_rpc":      true,
+}
+
+// bodyLimit returns the largest request body that will be read for a
+// request to path, or 0 if there's no limit. Unless it's set with
+// -max-body-size, it's the size needed to upload a single value of
+// maxValueSize bytes; that doesn't apply to the bulk endpoints, which
+// would otherwise refuse a dump of any real store.
+func bodyLimit(path string) int64 {
+	if maxBodySize > 0 {
+		return maxBodySize
+	}
+
+	if _, arg, ok := lookupEndpoint(path); ok && bulkEndpoints[path[:len(path)-len(arg)]] {
+		return 0
+	}
+
+	if maxValueSize > 0 {
+		return maxUploadSize()
+	}
+	return 0
+}
+
+// badBody returns the response for a request whose body couldn't be
+// read or decoded. A body larger than the limit results in an HTTP
+// Request Entity Too Large, whose data gives the limit in a form
+// clients can act on, and anything else an HTTP Bad Request.
+func badBody(err error) *Response {
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		return &Response{
+			Status: http.StatusRequestEntityTooLarge,
+			Data: map[string]interface{}{
+				"error":   "body_too_large",
+				"limit":   tooBig.Limit,
+				"message": fmt.Sprintf("request bodies may be at most %d bytes", tooBig.Limit),
+			},
+		}
+	}
+
+	return &Response{
+		Status: http.StatusBadRequest,
+		Data:   err.Error(),
+	}
+}
+
+// An uploadRequest is the body of a POST to a key. Only the value is
+// required.
+type uploadRequest struct {
+	Value    *string `json:"value"`
+	Field    *string `json:"field"`
+	Filename *string `json:"filename"`
+	TTL      *int64  `json:"ttl"` // Seconds until the key expires.
+
+	// ExpiresAt is the RFC3339 time at which the key expires, as
+	// an alternative to TTL.
+	ExpiresAt *string `json:"expires_at"`
+}
+
+// expiry returns the Unix timestamp at which the key in body should
+// expire, or 0 if the body doesn't give an expiry.
+func (body *uploadRequest) expiry(now time.Time) (int64, error) {
+	if body.TTL != nil && body.ExpiresAt != nil {
+		return 0, errors.New("only one of ttl and expires_at may be given")
+	}
+
+	if body.TTL != nil {
+		if *body.TTL <= 0 {
+			return 0, errors.New("ttl must be a positive number of seconds")
+		}
+		return now.Unix() + *body.TTL, nil
+	}
+
+	if body.ExpiresAt != nil {
+		t, err := time.Parse(time.RFC3339, *body.ExpiresAt)
+		if err != nil {
+			return 0, errors.New("expires_at must be an RFC3339 time")
+		}
+
+		if t.Unix() <= now.Unix() {
+			return 0, errors.New("expires_at is in the past")
+		}
+		return t.Unix(), nil
+	}
+
+	return 0, nil
 }
 
 // uploadKey reads value for key from the HTTP request body, updates
-// the value in the store, and writes the store to disk. If there is
-// an error getting the value (e.g. invalid JSON or no 'value' key in
-// the JSON), an HTTP Bad Request is returned. If the store file could
-// not be written, an HTTP Internal Server Error is returned.
+// the value in the store, and writes the store to disk. If the body
+// also contains a 'field' key, the named field of the key's value is
+// updated instead of the value itself. If it contains a 'ttl', the key
+// expires after that many seconds, and if it contains an 'expires_at'
+// RFC3339 time, the key expires at that time; a GET of the key returns
+// the resolved expiry as its ExpiresAt Unix timestamp. If there is an
+// error getting the value (e.g. invalid JSON or no 'value' key in the
+// JSON), an HTTP Bad Request is returned. If the write would take the
+// store over its size limit, an HTTP Insufficient Storage is returned,
+// and if the key is numeric and the value isn't a number, an HTTP
+// Conflict is returned. If the store file could not be written, an
+// HTTP Internal Server Error is returned. A key that fails validateKey
+// results in an HTTP Bad Request.
+//
+// If the request has an If-Match header, the value is only written if
+// the key is at the version given in the header (0 for a new key), or
+// still has the ETag given in it; otherwise, an HTTP Precondition
+// Failed is returned.
+//
+// On success, the response data is empty unless the request has a
+// return query parameter: return=value returns the stored value, and
+// return=previous returns the value it replaced (null for a new key).
+// If the server was started with -noop-204, a write that doesn't
+// change the store is answered with an HTTP No Content instead.
 func uploadKey(w http.ResponseWriter, req *http.Request, key string) *Response {
-	var m = map[string]string{}
+	atomic.AddInt64(&counters.sets, 1)
+	if err := validateKey(key); err != nil {
+		return &Response{
+			Status: http.StatusBadRequest,
+			Data:   err.Error(),
+		}
+	}
+
+	var body uploadRequest
 	in, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return badBody(err)
+	}
+
+	err = json.Unmarshal(in, &body)
+	if err != nil {
+		return &Response{
+			Status: http.StatusBadRequest,
+			Data:   err.Error(),
+		}
+	}
+
+	if body.Value == nil {
+		return &Response{
+			Status: http.StatusBadRequest,
+			Data:   "no value provided for key " + key,
+		}
+	}
+	value := *body.Value
+	if tooLarge(value) {
+		return valueTooLarge()
+	}
+
+	expiresAt, err := body.expiry(time.Now())
 	if err != nil {
 		return &Response{
 			Status: http.StatusBadRequest,
@@ -41,7 +378,7 @@ func uploadKey(w http.ResponseWriter, req *http.Request, key string) *Response {
 		}
 	}
 
-	err = json.Unmarshal(in, &m)
+	err = validateValue(key, value)
 	if err != nil {
 		return &Response{
 			Status: http.StatusBadRequest,
@@ -49,16 +386,85 @@ func uploadKey(w http.ResponseWriter, req *http.Request, key string) *Response {
 		}
 	}
 
-	value, ok := m["value"]
-	if !ok {
+	expected, cas, err := ifMatch(req)
+	if err != nil {
 		return &Response{
 			Status: http.StatusBadRequest,
-			Data:   "no value provided for key " + key,
+			Data:   err.Error(),
+		}
+	}
+
+	if !inMemory() && (body.Field != nil || body.Filename != nil || expiresAt != 0 || cas) {
+		return notImplemented("setting a field, filename, expiry or If-Match")
+	}
+
+	var changed int
+	var updated bool
+	var prev *Value
+	switch {
+	case body.Field != nil && cas:
+		return &Response{
+			Status: http.StatusBadRequest,
+			Data:   "If-Match can't be used when setting a field",
+		}
+	case body.Field != nil:
+		prev, updated, err = setField(key, *body.Field, value)
+		auditWrite(req.RemoteAddr, "set", key+"/"+*body.Field, updated)
+	case cas:
+		prev, updated, err = setValueCAS(key, value, expected)
+		auditWrite(req.RemoteAddr, "set", key, updated)
+	default:
+		prev, updated, err = backend.Set(key, value)
+		auditWrite(req.RemoteAddr, "set", key, updated)
+	}
+
+	switch err {
+	case nil:
+	case errVersionConflict:
+		return &Response{
+			Status: http.StatusPreconditionFailed,
+			Data:   fmt.Sprintf("key '%s' %s", key, expected.unmet()),
+		}
+	case errVersionReset:
+		return &Response{
+			Status: http.StatusPreconditionFailed,
+			Data:   fmt.Sprintf("key '%s' has had its version reset; read it again for its current ETag", key),
+		}
+	case errStoreFull:
+		return storeFull()
+	case errTypeMismatch:
+		if body.Field != nil {
+			return &Response{
+				Status: http.StatusConflict,
+				Data:   fmt.Sprintf("key '%s' is numeric and can't have fields", key),
+			}
+		}
+		return &Response{
+			Status: http.StatusConflict,
+			Data:   fmt.Sprintf("key '%s' is numeric and can only be set to a number", key),
+		}
+	default:
+		return &Response{
+			Status: http.StatusInternalServerError,
+			Data:   "server encountered an error storing the key / value pairs",
+		}
+	}
+
+	if body.Filename != nil {
+		if setFilename(key, sanitizeFilename(*body.Filename)) {
+			updated = true
+		}
+	}
+
+	if expiresAt != 0 {
+		if setExpiry(key, expiresAt) {
+			updated = true
 		}
 	}
 
-	if setValue(key, value) {
-		err = writeStore()
+	if updated {
+		changed = 1
+		err = persistKey(key)
 		if err != nil {
 			return &Response{
 				Status: http.StatusInternalServerError,
@@ -67,16 +473,118 @@ func uploadKey(w http.ResponseWriter, req *http.Request, key string) *Response {
 		}
 	}
 
+	r := &Response{
+		Status:   http.StatusOK,
+		Data:     "",
+		Affected: affected(changed),
+	}
+
+	if !updated && noopNoContent {
+		r.Status = http.StatusNoContent
+		return r
+	}
+
+	switch req.URL.Query().Get("return") {
+	case "value":
+		if v, ok := backend.Get(key); ok {
+			r.Data = v.public()
+		}
+	case "previous":
+		if prev != nil {
+			r.Data = prev.public()
+		} else {
+			r.Data = nil
+		}
+	}
+
+	return r
+}
+
+// diffDump compares a dump of the store, uploaded in the request body,
+// with the current store and returns the keys that differ. If the dump
+// is malformed, an HTTP Bad Request is returned.
+func diffDump(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	diff, err := diffStore(req.Body)
+	if err != nil {
+		return badBody(err)
+	}
+
 	return &Response{
 		Status: http.StatusOK,
-		Data:   "",
+		Data:   diff,
 	}
 }
 
-// retrieveKey looks up key in the store. If it's present, the value is
-// returned. Otherwise, an HTTP 404 is returned.
-func retrieveKey(w http.ResponseWriter, key string) *Response {
-	value, ok := getValue(key)
+// numericData returns the response data for a numeric value.
+func numericData(v Value) map[string]interface{} {
+	return map[string]interface{}{
+		"value":   json.Number(v.Value),
+		"version": v.Version,
+	}
+}
+
+// incrKey atomically adds the delta given in the request body, as
+// {'delta': <n>}, to the integer stored under key, and returns the new
+// value. A missing key is treated as 0, and isn't created by a delta of
+// 0; a key that doesn't hold an integer results in an HTTP 400.
+func incrKey(w http.ResponseWriter, req *http.Request, key string) *Response {
+	if err := validateKey(key); err != nil {
+		return &Response{
+			Status: http.StatusBadRequest,
+			Data:   err.Error(),
+		}
+	}
+
+	var body struct {
+		Delta *int64 `json:"delta"`
+	}
+
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err == nil && body.Delta == nil {
+		err = errors.New("no delta provided for key " + key)
+	}
+
+	if err != nil {
+		return badBody(err)
+	}
+
+	n, err := incrValue(key, *body.Delta)
+	auditWrite(req.RemoteAddr, "incr", key, err == nil && *body.Delta != 0)
+	switch err {
+	case nil:
+	case errStoreFull:
+		return storeFull()
+	default:
+		return &Response{
+			Status: http.StatusBadRequest,
+			Data:   fmt.Sprintf("key '%s': %v", key, err),
+		}
+	}
+
+	changed := 0
+	if *body.Delta != 0 {
+		changed = 1
+		err = persistKey(key)
+		if err != nil {
+			return &Response{
+				Status: http.StatusInternalServerError,
+				Data:   "server encountered an error storing the key / value pairs",
+			}
+		}
+	}
+
+	return &Response{
+		Status:   http.StatusOK,
+		Data:     n,
+		Affected: affected(changed),
+	}
+}
+
+// retrieveNumber returns the value of a numeric key as a JSON number.
+// If the key isn't present, an HTTP 404 is returned, and if it isn't
+// numeric, an HTTP Conflict is returned.
+func retrieveNumber(w http.ResponseWriter, req *http.Request, key string) *Response {
+	v, ok, err := getNumber(key)
 	if !ok {
 		return &Response{
 			Status: http.StatusNotFound,
@@ -84,88 +592,1524 @@ func retrieveKey(w http.ResponseWriter, key string) *Response {
 		}
 	}
 
+	if err != nil {
+		return &Response{
+			Status: http.StatusConflict,
+			Data:   fmt.Sprintf("key '%s' isn't numeric", key),
+		}
+	}
+
 	return &Response{
 		Status: http.StatusOK,
-		Data:   value,
+		Data:   numericData(v),
 	}
 }
 
-// handler determines which key is being requested. If it's the empty key,
-// then the request is for the index. Otherwise, it's a request for an
-// operation on a key.
-//
-// The metrics endpoint only accepts GET requests. Any other method
-// results in an HTTP Method Not Allowed error.
-//
-// If a request for an operation on a key is a GET request, the
-// retrieveKey handler is called on the key. If it's a POST request,
-// the uploadKey handler is called. Any other method results in an
-// HTTP Method Not Allowed Error.
-func handler(w http.ResponseWriter, req *http.Request) {
-	var r *Response
-	key := req.URL.Path[1:]
+// updateNumber applies a numeric operation to a key. The request body
+// is a JSON object with an 'op' (one of set, add, sub, min or max) and
+// a numeric 'operand'. The resulting value is returned. An invalid
+// operation or operand results in an HTTP Bad Request, and an
+// operation on a string key results in an HTTP Conflict.
+func updateNumber(w http.ResponseWriter, req *http.Request, key string) *Response {
+	if err := validateKey(key); err != nil {
+		return &Response{
+			Status: http.StatusBadRequest,
+			Data:   err.Error(),
+		}
+	}
 
-	if key == "" {
-		if req.Method != "GET" {
-			r = &Response{
-				Data:   "invalid method " + req.Method,
-				Status: http.StatusMethodNotAllowed,
-			}
-		} else {
-			r = &Response{
-				Status: http.StatusOK,
-				Data:   store.metrics,
-			}
+	var body struct {
+		Op      string      `json:"op"`
+		Operand json.Number `json:"operand"`
+	}
+
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		return badBody(err)
+	}
+
+	v, changed, err := numericOp(key, body.Op, string(body.Operand))
+	auditWrite(req.RemoteAddr, "num", key, changed)
+	switch err {
+	case nil:
+	case errStoreFull:
+		return storeFull()
+	case errTypeMismatch:
+		return &Response{
+			Status: http.StatusConflict,
+			Data:   fmt.Sprintf("key '%s' isn't numeric", key),
 		}
-	} else {
-		switch req.Method {
-		case "POST":
-			r = uploadKey(w, req, key)
-		case "GET":
-			r = retrieveKey(w, key)
-		default:
-			r = &Response{
-				Data:   "invalid method " + req.Method,
-				Status: http.StatusMethodNotAllowed,
+	default:
+		return &Response{
+			Status: http.StatusBadRequest,
+			Data:   err.Error(),
+		}
+	}
+
+	n := 0
+	if changed {
+		n = 1
+		err = persistKey(key)
+		if err != nil {
+			return &Response{
+				Status: http.StatusInternalServerError,
+				Data:   "server encountered an error storing the key / value pairs",
 			}
 		}
 	}
-	req.Body.Close()
 
-	out, err := json.Marshal(r)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("error forming response"))
-	} else {
-		buf := &bytes.Buffer{}
-		json.Indent(buf, out, "", "        ")
-		w.WriteHeader(r.Status)
-		w.Write(buf.Bytes())
+	return &Response{
+		Status:   http.StatusOK,
+		Data:     numericData(v),
+		Affected: affected(n),
 	}
 }
 
-func main() {
-	var addr string
-
-	flag.StringVar(&addr, "a", "localhost:8000", "`address` to listen on")
-	flag.StringVar(&store.file, "f", "store.json", "`path` to store data file")
-	flag.Parse()
+// removeKey deletes a key from the store, which is written to disk
+// afterwards. If the key isn't present, an HTTP 404 is returned.
+func removeKey(w http.ResponseWriter, req *http.Request, key string) *Response {
+	atomic.AddInt64(&counters.deletes, 1)
+	if !backend.Delete(key) {
+		return &Response{
+			Status: http.StatusNotFound,
+			Data:   fmt.Sprintf("key '%s' doesn't exist in the store", key),
+		}
+	}
+	auditWrite(req.RemoteAddr, "delete", key, true)
 
-	in, err := ioutil.ReadFile(store.file)
+	err := persist()
 	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Fatal(err)
-		}
-	} else {
-		err = json.Unmarshal(in, &store.values)
-		if err != nil {
-			log.Fatal(err)
+		return &Response{
+			Status: http.StatusInternalServerError,
+			Data:   "server encountered an error storing the key / value pairs",
 		}
 	}
 
-	setupMetrics()
+	return &Response{
+		Status:   http.StatusOK,
+		Data:     "",
+		Affected: affected(1),
+	}
+}
 
-	http.HandleFunc("/", handler)
-	log.Println("listening on", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+// popKey atomically retrieves and removes a key from the store, which
+// is written to disk afterwards. If the key isn't present, an HTTP 404
+// is returned.
+func popKey(w http.ResponseWriter, req *http.Request, key string) *Response {
+	value, ok := popValue(key)
+	if !ok {
+		return &Response{
+			Status: http.StatusNotFound,
+			Data:   fmt.Sprintf("key '%s' doesn't exist in the store", key),
+		}
+	}
+	auditWrite(req.RemoteAddr, "pop", key, true)
+
+	err := persist()
+	if err != nil {
+		return &Response{
+			Status: http.StatusInternalServerError,
+			Data:   "server encountered an error storing the key / value pairs",
+		}
+	}
+
+	return &Response{
+		Status:   http.StatusOK,
+		Data:     value.public(),
+		Affected: affected(1),
+	}
+}
+
+// GetOrSet is the result of a get-or-set request. It is exported so
+// that it may be serialised by the JSON package.
+type GetOrSet struct {
+	Created bool  `json:"created"`
+	Value   Value `json:"value"`
+}
+
+// getOrSetKey returns the value stored under key, or if the key isn't
+// present, stores the value given in the request body, as
+// {'value': <value>}, and returns that. The store is only written if
+// the key was created.
+func getOrSetKey(w http.ResponseWriter, req *http.Request, key string) *Response {
+	if err := validateKey(key); err != nil {
+		return &Response{
+			Status: http.StatusBadRequest,
+			Data:   err.Error(),
+		}
+	}
+
+	var body struct {
+		Value *string `json:"value"`
+	}
+
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		return badBody(err)
+	}
+
+	if body.Value == nil {
+		return &Response{
+			Status: http.StatusBadRequest,
+			Data:   "no default value provided for key " + key,
+		}
+	}
+
+	if tooLarge(*body.Value) {
+		return valueTooLarge()
+	}
+
+	err = validateValue(key, *body.Value)
+	if err != nil {
+		return &Response{
+			Status: http.StatusBadRequest,
+			Data:   err.Error(),
+		}
+	}
+
+	value, created, err := getOrSet(key, *body.Value)
+	auditWrite(req.RemoteAddr, "getorset", key, created)
+	if err == errStoreFull {
+		return storeFull()
+	}
+
+	changed := 0
+	if created {
+		changed = 1
+		err = persistKey(key)
+		if err != nil {
+			return &Response{
+				Status: http.StatusInternalServerError,
+				Data:   "server encountered an error storing the key / value pairs",
+			}
+		}
+	}
+
+	return &Response{
+		Status:   http.StatusOK,
+		Data:     GetOrSet{Created: created, Value: value.public()},
+		Affected: affected(changed),
+	}
+}
+
+// sanitizeFilename strips any directory components from name and
+// replaces characters that aren't safe to put in a
+// Content-Disposition header.
+func sanitizeFilename(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.' || r == '-' || r == '_' || r == ' ':
+			return r
+		}
+		return '_'
+	}, name)
+
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+// downloadValue writes the raw value to w as an attachment, with the
+// content type set by -default-content-type.
+func downloadValue(w http.ResponseWriter, key string, value Value) {
+	filename := value.Filename
+	if filename == "" {
+		filename = sanitizeFilename(key)
+	}
+
+	w.Header().Set("Content-Type", defaultContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(value.Value))
+}
+
+// retrieveKey looks up key in the store. If it's present, the value is
+// returned. Otherwise, an HTTP 404 is returned. ETag and Last-Modified
+// headers are set for the value, and a conditional request for a value
+// the client already has is answered with an HTTP 304. If the request
+// has a download=1 query parameter, the raw value is written directly
+// as an attachment and no response is returned. A ttl=1 query parameter
+// returns the number of seconds until the key expires instead of the
+// value, or -1 if it doesn't expire. A snapshot query parameter holding
+// a token from /_snapshot reads the key as it was when the snapshot was
+// taken; an unknown or expired token results in an HTTP 410. If the
+// server keeps history, a version query parameter returns that
+// version of the value, or an HTTP 404 if it isn't retained.
+func retrieveKey(w http.ResponseWriter, req *http.Request, key string) *Response {
+	var value Value
+	var ok bool
+	query := req.URL.Query()
+	if token := query.Get("snapshot"); token != "" {
+		f, found := getSnapshot(token)
+		if !found {
+			return &Response{
+				Status: http.StatusGone,
+				Data:   "snapshot doesn't exist or has expired",
+			}
+		}
+		value, ok = f.get(key)
+	} else {
+		value, ok = backend.Get(key)
+	}
+
+	countGet(ok)
+	if !ok {
+		return &Response{
+			Status: http.StatusNotFound,
+			Data:   fmt.Sprintf("key '%s' doesn't exist in the store", key),
+		}
+	}
+
+	if param := query.Get("version"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil {
+			return &Response{
+				Status: http.StatusBadRequest,
+				Data:   "invalid version " + param,
+			}
+		}
+
+		value, ok = value.atVersion(n)
+		if !ok {
+			return &Response{
+				Status: http.StatusNotFound,
+				Data:   fmt.Sprintf("version %d of key '%s' isn't retained", n, key),
+			}
+		}
+	}
+
+	if query.Get("ttl") == "1" {
+		ttl := int64(-1)
+		if value.ExpiresAt != 0 {
+			ttl = value.ExpiresAt - time.Now().Unix()
+		}
+
+		return &Response{
+			Status: http.StatusOK,
+			Data:   ttl,
+		}
+	}
+
+	setValidators(w, value)
+	if notModified(req, value) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	if query.Get("download") == "1" {
+		downloadValue(w, key, value)
+		return nil
+	}
+
+	return &Response{
+		Status: http.StatusOK,
+		Data:   value.public(),
+	}
+}
+
+// etag returns the entity tag for v, which is derived from its
+// version, and its epoch if the version has been reset. Changing a
+// field doesn't bump the version, so the versions of the fields are
+// added in if there are any. Neither does changing the expiry time or
+// filename, so if either is set, a hash of them is appended.
+func etag(v Value) string {
+	tag := fmt.Sprintf("v%d", v.Version)
+	if v.Epoch > 0 {
+		tag = fmt.Sprintf("e%d.%s", v.Epoch, tag)
+	}
+	if len(v.Fields) > 0 {
+		fields := 0
+		for _, f := range v.Fields {
+			fields += f.Version
+		}
+		tag += fmt.Sprintf(".%d", fields)
+	}
+
+	if v.ExpiresAt != 0 || v.Filename != "" {
+		h := fnv.New32a()
+		fmt.Fprintf(h, "%d/%s", v.ExpiresAt, v.Filename)
+		tag += fmt.Sprintf("-%08x", h.Sum32())
+	}
+	return `"` + tag + `"`
+}
+
+// setValidators sets the ETag and Last-Modified headers for v.
+func setValidators(w http.ResponseWriter, v Value) {
+	w.Header().Set("ETag", etag(v))
+	w.Header().Set("Last-Modified", time.Unix(v.Updated, 0).UTC().Format(http.TimeFormat))
+}
+
+// notModified reports whether req is a conditional request for v that
+// the client's copy satisfies. If-None-Match takes precedence over
+// If-Modified-Since, as it does in RFC 7232.
+func notModified(req *http.Request, v Value) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		tag := etag(v)
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == tag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		return err == nil && v.Updated <= t.Unix()
+	}
+
+	return false
+}
+
+// headKey reports whether key is in the store without returning its
+// value. The key's version and last update time are returned in the
+// X-Version, ETag and Last-Modified headers. It counts as a get in the
+// metrics.
+func headKey(w http.ResponseWriter, req *http.Request, key string) *Response {
+	value, ok := backend.Get(key)
+	countGet(ok)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	w.Header().Set("X-Version", strconv.Itoa(value.Version))
+	setValidators(w, value)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// invalidMethod returns the response for a request whose method isn't
+// supported by the endpoint it was made to.
+func invalidMethod(req *http.Request) *Response {
+	return &Response{
+		Data:   "invalid method " + req.Method,
+		Status: http.StatusMethodNotAllowed,
+	}
+}
+
+// An endpoint handles a request to one of the server's reserved paths.
+// Endpoints that are registered for a path prefix are passed the rest
+// of the path as arg. An endpoint that writes its own response returns
+// nil.
+type endpoint func(w http.ResponseWriter, req *http.Request, arg string) *Response
+
+// endpoints maps the reserved paths to the endpoints registered for
+// each method. The empty path is the index. Apart from the index, all
+// reserved paths begin with an underscore; a path ending in a slash
+// handles every path beneath it.
+var endpoints = map[string]map[string]endpoint{
+	"": {
+		"GET": index,
+	},
+	"_diffdump": {
+		"POST": diffDump,
+	},
+	"_expiring": {
+		"GET": expiring,
+	},
+	"_expire/run": {
+		"POST": runExpiry,
+	},
+	"_export": {
+		"GET": export,
+	},
+	"_getorset/": {
+		"POST": getOrSetKey,
+	},
+	"_health": {
+		"GET": health,
+	},
+	"_history/": {
+		"GET": history,
+	},
+	"_import": {
+		"POST": importStore,
+	},
+	"_incr/": {
+		"POST": incrKey,
+	},
+	"_keys": {
+		"GET": keys,
+	},
+	"_metrics": {
+		"GET": prometheusMetrics,
+	},
+	"_mget": {
+		"POST": multiGet,
+	},
+	"_mset": {
+		"POST": multiSet,
+	},
+	"_num/": {
+		"GET":  retrieveNumber,
+		"POST": updateNumber,
+	},
+	"_pop/": {
+		"POST": popKey,
+	},
+	"_recent": {
+		"GET": recent,
+	},
+	"_rpc": {
+		"POST": rpcEndpoint,
+	},
+	"_snapshot": {
+		"GET":  newSnapshot,
+		"POST": backup,
+	},
+	"_stats/prefixes": {
+		"GET": statsByPrefix,
+	},
+	"_stream": {
+		"GET": streamChanges,
+	},
+	"_uptime": {
+		"GET": uptime,
+	},
+}
+
+// lookupEndpoint finds the endpoints registered for path, returning
+// them along with the endpoint argument.
+func lookupEndpoint(path string) (map[string]endpoint, string, bool) {
+	if methods, ok := endpoints[path]; ok {
+		return methods, "", true
+	}
+
+	if i := strings.Index(path, "/"); i >= 0 {
+		if methods, ok := endpoints[path[:i+1]]; ok {
+			return methods, path[i+1:], true
+		}
+	}
+
+	return nil, "", false
+}
+
+// flatten adds the leaves of the decoded JSON value v to out, naming
+// nested values by joining their keys with dots.
+func flatten(out map[string]string, name string, v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range v {
+			if name != "" {
+				k = name + "." + k
+			}
+			flatten(out, k, sub)
+		}
+	case nil:
+		out[name] = ""
+	default:
+		out[name] = fmt.Sprint(v)
+	}
+}
+
+// writeMetricsCSV writes the metrics as a two-column (name, value) CSV
+// file, sorted by name.
+func writeMetricsCSV(w http.ResponseWriter, metrics Metrics) {
+	var decoded interface{}
+	out, err := json.Marshal(metrics)
+	if err == nil {
+		dec := json.NewDecoder(bytes.NewReader(out))
+		dec.UseNumber()
+		err = dec.Decode(&decoded)
+	}
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("error forming response"))
+		return
+	}
+
+	fields := map[string]string{}
+	flatten(fields, "", decoded)
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "value"})
+	for _, name := range names {
+		cw.Write([]string{name, fields[name]})
+	}
+	cw.Flush()
+}
+
+// index returns the store metrics. If the request has a format=csv
+// query parameter, the metrics are written as CSV instead. If the
+// server was started with -metrics-cache, the metrics may be up to
+// that old. If the server was started with -report-empty, an empty
+// store is flagged in the metrics, and if it's read-only, the metrics
+// say so.
+func index(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	metrics := cachedMetrics()
+	metrics.StartTime = started.Unix()
+	metrics.UptimeSeconds = int64(time.Since(started).Seconds())
+	metrics.MaxValueSize = maxValueSize
+	metrics.ReadOnly = readOnly
+	if reportEmpty && metrics.Size == 0 {
+		metrics.Empty = true
+	}
+
+	if req.URL.Query().Get("format") == "csv" {
+		writeMetricsCSV(w, metrics)
+		return nil
+	}
+
+	return &Response{
+		Status: http.StatusOK,
+		Data:   metrics,
+	}
+}
+
+// Limits on the number of keys returned by the recent endpoint.
+const (
+	defaultRecentLimit = 10
+	maxRecentLimit     = 1000
+)
+
+// recent lists the most recently updated keys. The limit query
+// parameter sets the number of keys returned, and order=asc lists the
+// least recently updated keys instead.
+func recent(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	query := req.URL.Query()
+	limit := defaultRecentLimit
+	if param := query.Get("limit"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 {
+			return &Response{
+				Status: http.StatusBadRequest,
+				Data:   "invalid limit " + param,
+			}
+		}
+		limit = n
+	}
+
+	if limit > maxRecentLimit {
+		limit = maxRecentLimit
+	}
+
+	var newest bool
+	switch query.Get("order") {
+	case "", "desc":
+		newest = true
+	case "asc":
+		newest = false
+	default:
+		return &Response{
+			Status: http.StatusBadRequest,
+			Data:   "order must be asc or desc",
+		}
+	}
+
+	return &Response{
+		Status: http.StatusOK,
+		Data:   recentKeys(limit, newest),
+	}
+}
+
+// multiSet sets several keys at once. The request body is
+// {'pairs': {<key>: <value>, ...}}. All of the pairs are applied
+// together, or none of them are, and the store is written once
+// afterwards. The response reports whether each key was "written" or
+// "unchanged". If the write to disk fails, the changes remain in
+// memory, and the error says so.
+func multiSet(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	var body struct {
+		Pairs map[string]string `json:"pairs"`
+	}
+
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		return badBody(err)
+	}
+
+	for key, value := range body.Pairs {
+		if err = validateKey(key); err != nil {
+			return &Response{
+				Status: http.StatusBadRequest,
+				Data:   fmt.Sprintf("key '%s': %v", key, err),
+			}
+		}
+
+		if tooLarge(value) {
+			return valueTooLarge()
+		}
+
+		err = validateValue(key, value)
+		if err != nil {
+			return &Response{
+				Status: http.StatusBadRequest,
+				Data:   fmt.Sprintf("key '%s': %v", key, err),
+			}
+		}
+	}
+
+	changed, bad, err := setValues(body.Pairs)
+	switch err {
+	case nil:
+	case errStoreFull:
+		return storeFull()
+	case errTypeMismatch:
+		return &Response{
+			Status: http.StatusConflict,
+			Data:   fmt.Sprintf("key '%s' is numeric and can only be set to a number", bad),
+		}
+	}
+
+	n := 0
+	status := make(map[string]string, len(changed))
+	for key, ok := range changed {
+		auditWrite(req.RemoteAddr, "set", key, ok)
+		status[key] = "unchanged"
+		if ok {
+			status[key] = "written"
+			n++
+		}
+	}
+
+	if n > 0 {
+		err = persist()
+		if err != nil {
+			return &Response{
+				Status: http.StatusInternalServerError,
+				Data:   "the keys were updated in memory, but the server encountered an error storing them",
+			}
+		}
+	}
+
+	return &Response{
+		Status:   http.StatusOK,
+		Data:     status,
+		Affected: affected(n),
+	}
+}
+
+// multiGet returns the values of several keys at once. The request
+// body is {'keys': [<key>, ...]}, and the response maps each key to its
+// value, or to null if the key doesn't exist.
+func multiGet(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	var body struct {
+		Keys []string `json:"keys"`
+	}
+
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		return badBody(err)
+	}
+
+	values := getValues(body.Keys)
+	for key, v := range values {
+		countGet(v != nil)
+		if v != nil {
+			p := v.public()
+			values[key] = &p
+		}
+	}
+
+	return &Response{
+		Status: http.StatusOK,
+		Data:   values,
+	}
+}
+
+// keys returns the names of the keys in the store, sorted. The prefix
+// query parameter limits the list to keys beginning with that prefix.
+// A list larger than -max-list-bytes results in an HTTP Request Entity
+// Too Large.
+func keys(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	list, err := backend.List(req.URL.Query().Get("prefix"))
+	switch err {
+	case nil:
+	case errListTooLarge:
+		return &Response{
+			Status: http.StatusRequestEntityTooLarge,
+			Data:   listTooLarge(),
+		}
+	default:
+		return &Response{
+			Status: http.StatusInternalServerError,
+			Data:   "server encountered an error listing the keys",
+		}
+	}
+
+	return &Response{
+		Status: http.StatusOK,
+		Data:   list,
+	}
+}
+
+// listTooLarge explains why a list of keys was refused.
+func listTooLarge() string {
+	return fmt.Sprintf("the list of keys would be larger than %d bytes; use the prefix parameter to list fewer keys", maxListBytes)
+}
+
+// expiring lists the keys that will expire within the number of
+// seconds given by the within query parameter, soonest first, along
+// with when each expires. A missing or invalid window results in an
+// HTTP Bad Request.
+func expiring(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	param := req.URL.Query().Get("within")
+	within, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || within <= 0 {
+		return &Response{
+			Status: http.StatusBadRequest,
+			Data:   "within must be a positive number of seconds",
+		}
+	}
+
+	return &Response{
+		Status: http.StatusOK,
+		Data:   expiringKeys(within),
+	}
+}
+
+// runExpiry removes every expired key from the store without waiting
+// for the sweeper, returning the number removed. The store is only
+// written to disk if something was removed.
+func runExpiry(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	n := removeExpired()
+	if n > 0 {
+		err := persist()
+		if err != nil {
+			return &Response{
+				Status: http.StatusInternalServerError,
+				Data:   "the expired keys were removed in memory, but the server encountered an error storing the change",
+			}
+		}
+	}
+
+	return &Response{
+		Status:   http.StatusOK,
+		Data:     n,
+		Affected: affected(n),
+	}
+}
+
+// statsByPrefix returns the number of keys and total value size for
+// each key prefix. A prefix is the part of a key before the delimiter
+// given by the delim query parameter, or the -prefix-delim flag if the
+// parameter isn't given.
+func statsByPrefix(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	delim := prefixDelim
+	if param, ok := req.URL.Query()["delim"]; ok && param[0] != "" {
+		delim = param[0]
+	}
+
+	return &Response{
+		Status: http.StatusOK,
+		Data:   prefixStats(delim),
+	}
+}
+
+// streamChanges streams changes to the store as they happen, written
+// as one JSON object per line. The prefix query parameter limits the
+// stream to keys beginning with that prefix. The stream continues
+// until the client disconnects, or is ended by the server if the
+// client can't keep up.
+func streamChanges(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return &Response{
+			Status: http.StatusInternalServerError,
+			Data:   "streaming isn't supported",
+		}
+	}
+
+	ch := subscribe(req.URL.Query().Get("prefix"))
+	defer unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case c, ok := <-ch:
+			if !ok {
+				return nil
+			}
+
+			if enc.Encode(c) != nil {
+				return nil
+			}
+			flusher.Flush()
+		case <-req.Context().Done():
+			return nil
+		}
+	}
+}
+
+// export streams the whole store as a JSON object, in the same format
+// as the store file, as an attachment named after the store file. The
+// store is encoded directly to the response rather than being buffered
+// first.
+func export(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	filename := "store.json"
+	if persistent() {
+		filename = sanitizeFilename(filepath.Base(store.file))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	err := exportValues(w)
+	if err != nil {
+		log.Printf("failed to export the store: %v", err)
+	}
+	return nil
+}
+
+// importStore merges a dump of the store, in the format written by
+// /_export, into the store. Every entry is checked before the store is
+// changed, and a malformed dump or entry results in an HTTP Bad
+// Request. By default, imported keys replace any current values; the
+// conflict query parameter chooses another policy from
+// conflictPolicies (incoming, existing, version or timestamp) for the
+// keys that are already in the store. With a mode=replace query
+// parameter, the keys that aren't in the dump are removed, so the store
+// ends up matching it; a conflict policy can't be given in this mode.
+// With -backup-before-destructive, a backup of the store is written
+// first, and its path is returned in the response as backup.
+// The store is written once afterwards, and the response reports how
+// many keys were imported, how many of those overwrote an existing key,
+// and how many were skipped in favour of the current value.
+//
+// There's no streamed progress: the entries are applied in memory under
+// a single hold of the store's lock, so there's nothing to report until
+// they've all been applied, and writing to a slow client while holding
+// the lock would stall every other request.
+func importStore(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	query := req.URL.Query()
+	var replace bool
+	switch mode := query.Get("mode"); mode {
+	case "", "merge":
+	case "replace":
+		replace = true
+	default:
+		return &Response{
+			Status: http.StatusBadRequest,
+			Data:   "mode must be merge or replace",
+		}
+	}
+
+	conflict := conflictPolicies["incoming"]
+	if name := query.Get("conflict"); name != "" {
+		var ok bool
+		conflict, ok = conflictPolicies[name]
+		if !ok {
+			return &Response{
+				Status: http.StatusBadRequest,
+				Data:   "conflict must be incoming, existing, version or timestamp",
+			}
+		}
+
+		if replace {
+			return &Response{
+				Status: http.StatusBadRequest,
+				Data:   "conflict can't be used with mode=replace",
+			}
+		}
+	}
+
+	values := map[string]*Value{}
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&values)
+	if err == nil {
+		err = checkValues(values)
+	}
+
+	if err != nil {
+		return badBody(err)
+	}
+
+	var path string
+	if replace {
+		path, err = destructiveBackup()
+		if err != nil {
+			return &Response{
+				Status: http.StatusInternalServerError,
+				Data:   "server encountered an error backing up the store, so it wasn't replaced: " + err.Error(),
+			}
+		}
+	}
+
+	total := len(values)
+	imported, overwritten, err := importValues(values, replace, conflict)
+	if err == errStoreFull {
+		return storeFull()
+	}
+
+	for key := range values {
+		auditWrite(req.RemoteAddr, "import", key, true)
+	}
+
+	if imported > 0 || replace {
+		err = persist()
+		if err != nil {
+			return &Response{
+				Status: http.StatusInternalServerError,
+				Data:   "the keys were imported in memory, but the server encountered an error storing them",
+			}
+		}
+	}
+
+	data := map[string]interface{}{
+		"imported":    imported,
+		"overwritten": overwritten,
+		"skipped":     total - imported,
+	}
+	if path != "" {
+		data["backup"] = path
+	}
+
+	return &Response{
+		Status:   http.StatusOK,
+		Data:     data,
+		Affected: affected(imported),
+	}
+}
+
+// health is a lightweight liveness check. It reports the server as
+// healthy unless the last write of the store failed, in which case it
+// returns an HTTP 503 with the write error.
+func health(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	if err := lastWriteError(); err != "" {
+		return &Response{
+			Status: http.StatusServiceUnavailable,
+			Data:   map[string]string{"status": "unavailable", "error": err},
+		}
+	}
+
+	return &Response{
+		Status: http.StatusOK,
+		Data:   map[string]string{"status": "ok"},
+	}
+}
+
+// uptime reports when the server was started and how long it has been
+// running.
+func uptime(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	return &Response{
+		Status: http.StatusOK,
+		Data: map[string]int64{
+			"started_at":     started.Unix(),
+			"uptime_seconds": int64(time.Since(started).Seconds()),
+		},
+	}
+}
+
+// handler determines which key is being requested. If it's one of the
+// reserved paths, such as the empty path for the index, the request is
+// passed to the endpoint registered for its method; a method without an
+// endpoint results in an HTTP Method Not Allowed error. Otherwise, it's
+// a request for an operation on a key.
+//
+// If a request for an operation on a key is a GET request, the
+// retrieveKey handler is called on the key, and if it's a HEAD
+// request, the headKey handler is called. If it's a POST request,
+// the uploadKey handler is called, and if it's a DELETE request, the
+// removeKey handler is called. Any other method results in an HTTP
+// Method Not Allowed Error.
+//
+// If a bearer token is configured, requests that could change the
+// store are rejected with an HTTP Unauthorized unless they carry it.
+// If the server was started with -client-ca, every request without a
+// client certificate signed by one of its CAs is rejected the same way.
+// Request bodies larger than the limit set by -max-body-size (or
+// implied by -max-value-size, for endpoints taking a single value)
+// aren't read past the limit, and result in an HTTP Request Entity Too
+// Large.
+//
+// If the server was started with -cors-origin, every response allows
+// requests from that origin, and OPTIONS preflight requests are
+// answered with an HTTP No Content.
+//
+// If the server was started with -rate, writes from each client are
+// limited to that rate, and requests over it are answered with an HTTP
+// Too Many Requests.
+//
+// If the server is read-only, requests that could change the store
+// are rejected with an HTTP Method Not Allowed. If access logging is
+// enabled, each request is logged with its status and how long it
+// took.
+func handler(w http.ResponseWriter, req *http.Request) {
+	var r *Response
+	key := req.URL.Path[1:]
+
+	start := time.Now()
+	var sw *statusWriter
+	if accessLog != nil {
+		sw = &statusWriter{ResponseWriter: w}
+		w = sw
+	}
+
+	// GET requests don't use a body, but any body that was sent
+	// must be read for the connection to be reused.
+	var drained int64
+	if req.Method == "GET" {
+		drained, _ = io.Copy(ioutil.Discard, io.LimitReader(req.Body, maxDrain))
+	}
+
+	if req.Method != "GET" {
+		if limit := bodyLimit(key); limit > 0 {
+			req.Body = http.MaxBytesReader(w, req.Body, limit)
+		}
+	}
+
+	// The CORS headers have to be set before any endpoint writes
+	// the status.
+	if corsOrigin != "" {
+		setCORS(w)
+	}
+
+	if preflight(req) {
+		r = &Response{Status: http.StatusNoContent}
+	} else if !certVerified(req) {
+		r = certRequired()
+	} else if !authorized(req) {
+		r = unauthorized(w)
+	} else if ok, wait := allowRequest(req); !ok {
+		r = tooManyRequests(w, wait)
+	} else if drained > 0 && rejectGetBody {
+		r = &Response{
+			Status: http.StatusBadRequest,
+			Data:   "GET requests must not have a body",
+		}
+	} else if readOnly && mutates(req, key) {
+		r = rejectWrite(req)
+	} else if methods, arg, ok := lookupEndpoint(key); ok {
+		if ep, ok := methods[req.Method]; ok {
+			r = ep(w, req, arg)
+		} else {
+			r = invalidMethod(req)
+		}
+	} else {
+		switch req.Method {
+		case "POST":
+			r = uploadKey(w, req, key)
+		case "GET":
+			r = retrieveKey(w, req, key)
+		case "HEAD":
+			r = headKey(w, req, key)
+		case "DELETE":
+			r = removeKey(w, req, key)
+		default:
+			r = invalidMethod(req)
+		}
+	}
+	req.Body.Close()
+
+	// A nil response means the endpoint has already written its
+	// own response.
+	if r != nil {
+		writeResponse(w, req, r)
+	}
+
+	if sw != nil {
+		status := sw.status
+		if r != nil {
+			status = r.Status
+		}
+		logAccess(req, status, time.Since(start))
+	}
+}
+
+// A deferredWriter holds off on writing the status header until the
+// first write of the response body, so that a response that fails to
+// encode can still be reported as an error.
+type deferredWriter struct {
+	w      http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (dw *deferredWriter) Write(p []byte) (int, error) {
+	if !dw.wrote {
+		dw.w.WriteHeader(dw.status)
+		dw.wrote = true
+	}
+	return dw.w.Write(p)
+}
+
+// maxIndent is the largest indentation a client may ask for.
+const maxIndent = 16
+
+// responseIndent returns the indentation to use for the response to
+// req. A client may choose the number of spaces with an indent query
+// parameter or an X-Pretty header, up to maxIndent; zero produces a
+// compact response. A pretty=false query parameter also produces a
+// compact response, and pretty=true the default indentation.
+// Otherwise, responses are indented with eight spaces unless the
+// server was started with -compact.
+func responseIndent(req *http.Request) string {
+	n := 8
+	if compact {
+		n = 0
+	}
+
+	query := req.URL.Query()
+	if pretty, err := strconv.ParseBool(query.Get("pretty")); err == nil {
+		n = 0
+		if pretty {
+			n = 8
+		}
+	}
+
+	param := query.Get("indent")
+	if param == "" {
+		param = req.Header.Get("X-Pretty")
+	}
+
+	if param != "" {
+		if i, err := strconv.Atoi(param); err == nil && i >= 0 {
+			n = i
+		}
+	}
+
+	if n > maxIndent {
+		n = maxIndent
+	}
+	return strings.Repeat(" ", n)
+}
+
+// writeResponse encodes r directly to the response writer, without an
+// intermediate buffer, using the indentation chosen by responseIndent.
+// No Content responses have no body. If the server was started with
+// -gzip and the client accepts it, responses of at least gzipMinSize
+// bytes are compressed. If the response can't be encoded, the error is
+// logged and a minimal envelope with the response's status is written
+// in its place.
+func writeResponse(w http.ResponseWriter, req *http.Request, r *Response) {
+	if r.Status == http.StatusNoContent {
+		w.WriteHeader(r.Status)
+		return
+	}
+
+	dw := &deferredWriter{w: w, status: r.Status}
+	var out io.Writer = dw
+	var gw *gzipWriter
+	if gzipResponses {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(req) {
+			gw = &gzipWriter{w: w, out: dw}
+			out = gw
+		}
+	}
+
+	enc := json.NewEncoder(out)
+	if indent := responseIndent(req); indent != "" {
+		enc.SetIndent("", indent)
+	}
+
+	err := enc.Encode(r)
+	if err == nil && gw != nil {
+		err = gw.Close()
+	}
+
+	if err == nil {
+		return
+	}
+
+	log.Printf("failed to encode response to %s /%s (status %d): %v",
+		req.Method, logKey(req.URL.Path[1:]), r.Status, err)
+	if dw.wrote {
+		return
+	}
+
+	// Fall back to an envelope that can't fail to encode, keeping
+	// the status the endpoint intended.
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(r.Status)
+	fmt.Fprintf(w, "{\"status\": %d, \"data\": \"error forming response\"}\n", r.Status)
+}
+
+// loadSeed reads seed data from path, which may be "-" to read from
+// standard input, and merges it into the store.
+func loadSeed(path string) (int, error) {
+	if path == "-" {
+		return seedStore(os.Stdin)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return seedStore(file)
+}
+
+func main() {
+	started = time.Now()
+
+	var accessPath, addr, auditPath, certFile, keyFile, seed, unixPath string
+	var auditNoops, check, memoryOnly, mkdir bool
+	var diskWriterLimit int
+	var backupInterval, grace, shutdownTimeout, sweepInterval time.Duration
+
+	flag.StringVar(&addr, "a", "localhost:8000", "`address` to listen on, or unix:<path> to listen on a Unix socket")
+	flag.StringVar(&unixPath, "unix", "", "`path` of a Unix socket to listen on, as well as the address (set -a to \"\" to only use the socket)")
+	flag.StringVar(&certFile, "cert", "", "TLS certificate `file`; with -key, serves HTTPS on the address (reloaded on SIGHUP)")
+	flag.StringVar(&keyFile, "key", "", "TLS private key `file`")
+	flag.StringVar(&tlsOptions.minVersion, "tls-min-version", tlsOptions.minVersion, "lowest TLS `version` to accept: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&tlsOptions.ciphers, "tls-ciphers", "", "comma-separated `list` of TLS 1.2 cipher suites to allow (empty uses Go's defaults)")
+	flag.StringVar(&clientCA, "client-ca", "", "`file` of CA certificates that clients must present a certificate signed by (requires -cert)")
+	flag.StringVar(&store.file, "f", "store.json", "`path` to store data file (\"\" to only keep the store in memory)")
+	flag.StringVar(&backendName, "backend", backendName, "storage `backend`: json, or bolt if built with -tags bolt")
+	flag.BoolVar(&memoryOnly, "memory", false, "only keep the store in memory, without a store file")
+	flag.BoolVar(&readOnly, "read-only", false, "reject requests that change the store, and never write the store file")
+	flag.IntVar(&diskWriterLimit, "max-disk-writers", 0, "maximum `number` of concurrent writes of the store file (0 for no limit)")
+	flag.DurationVar(&backupInterval, "snapshot-interval", 0, "`interval` between automatic backups of the store (0 disables them)")
+	flag.IntVar(&backupKeep, "backup-keep", 0, "`number` of backups from POST /_snapshot to keep (0 keeps all)")
+	flag.BoolVar(&backupDestructive, "backup-before-destructive", false, "back up the store before replacing it with POST /_import?mode=replace")
+	flag.Int64Var(&rotation.size, "rotate-size", 0, "rotate the store file once it's larger than `bytes` (0 disables rotation)")
+	flag.IntVar(&rotation.keep, "rotate-keep", rotation.keep, "`number` of rotated store files to keep")
+	flag.BoolVar(&check, "check", false, "check the store file for problems and exit")
+	flag.BoolVar(&mkdir, "mkdir", false, "create the store file's directory if it doesn't exist")
+	flag.StringVar(&auditPath, "audit", "", "`path` to append an audit log of writes to")
+	flag.StringVar(&accessPath, "access-log", "", "`path` to append an access log of requests to (- for stderr)")
+	flag.BoolVar(&auditNoops, "audit-noops", false, "audit writes that don't change the stored value")
+	flag.IntVar(&maxKeyLength, "max-key-length", maxKeyLength, "reject keys longer than `bytes` (0 for no limit)")
+	flag.Int64Var(&maxValueSize, "max-value-size", 0, "reject values larger than `bytes` (0 for no limit)")
+	flag.IntVar(&maxListBytes, "max-list-bytes", 0, "reject lists of keys larger than `bytes` (0 for no limit)")
+	flag.Int64Var(&maxBodySize, "max-body-size", 0, "reject request bodies larger than `bytes` (0 allows a single value of -max-value-size, and doesn't limit bulk endpoints)")
+	flag.Int64Var(&store.maxBytes, "hard-max-bytes", 0, "reject writes that would grow the store's values beyond `bytes` (0 for no limit)")
+	flag.StringVar(&auth.token, "auth-token", "", "bearer `token` required for requests that can change the store")
+	flag.BoolVar(&auth.reads, "auth-reads", false, "require the -auth-token for reads too")
+	flag.IntVar(&historyKeep, "history", 0, "`number` of previous versions to keep for each key (0 disables history)")
+	flag.IntVar(&versionCap.max, "max-version", 0, "warn when a key's version passes `version` (0 for no limit)")
+	flag.BoolVar(&versionCap.reset, "max-version-reset", false, "reset a key's version to 1 when it passes the -max-version instead of warning")
+	flag.BoolVar(&hashKeys, "hash-keys-in-logs", false, "log a truncated hash of keys instead of the keys themselves")
+	flag.StringVar(&prefixDelim, "prefix-delim", prefixDelim, "default `delimiter` ending a key prefix in prefix statistics")
+	flag.StringVar(&defaultContentType, "default-content-type", defaultContentType, "content `type` of downloaded values")
+	flag.DurationVar(&metricsCache.ttl, "metrics-cache", 0, "`duration` to reuse a copy of the metrics for (0 disables caching)")
+	flag.DurationVar(&metricsTryLock, "metrics-trylock", 0, "return stale metrics if the store is busy for longer than `duration` (0 always waits)")
+	flag.BoolVar(&reportEmpty, "report-empty", false, "flag an empty store in the index metrics")
+	flag.DurationVar(&debounce.quiet, "key-debounce", 0, "delay writing the store until a changed key has been quiet for `duration`")
+	flag.BoolVar(&noopNoContent, "noop-204", false, "answer writes that don't change the store with 204 No Content")
+	flag.BoolVar(&rejectGetBody, "reject-get-body", false, "reject GET requests that have a body")
+	flag.StringVar(&corsOrigin, "cors-origin", "", "`origin` that browsers may make requests from (\"*\" for any)")
+	flag.Float64Var(&limiter.rate, "rate", 0, "`requests` per second allowed from each client for writes (0 disables rate limiting)")
+	flag.IntVar(&limiter.burst, "burst", limiter.burst, "`number` of requests a client may make at once before -rate applies")
+	flag.BoolVar(&limiter.reads, "rate-reads", false, "apply -rate to reads as well as writes")
+	flag.BoolVar(&gzipResponses, "gzip", false, "gzip responses for clients that accept it")
+	flag.BoolVar(&compact, "compact", false, "don't indent responses")
+	flag.StringVar(&validator.cmd, "validate-cmd", "", "shell `command` to validate values with before writing")
+	flag.DurationVar(&validator.timeout, "validate-timeout", validator.timeout, "maximum `duration` of the validation command")
+	flag.DurationVar(&sweepInterval, "sweep-interval", 30*time.Second, "`interval` between sweeps for expired keys")
+	flag.IntVar(&sweepBatch, "sweep-batch", 0, "maximum `number` of expired keys to remove in each sweep (0 removes them all)")
+	flag.DurationVar(&flusher.interval, "flush-interval", time.Second, "minimum `interval` between writes of the store (0 writes on every change)")
+	flag.DurationVar(&grace, "flush-grace", 0, "`duration` after startup during which writes aren't flushed to disk")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "maximum `duration` to wait for requests to finish when shutting down")
+	flag.IntVar(&snapshots.max, "max-snapshots", snapshots.max, "maximum `number` of snapshot tokens held at once (0 for no limit)")
+	flag.DurationVar(&snapshots.ttl, "snapshot-ttl", snapshots.ttl, "`duration` that snapshot tokens can be read from")
+	flag.StringVar(&loadLog, "load-log", loadLog, "`level` of detail logged about the store loaded at startup: quiet, summary or verbose")
+	flag.StringVar(&seed, "seed", "", "JSON `file` to seed the store from (- for stdin)")
+	flag.Parse()
+
+	if check {
+		if !checkStoreFile(store.file) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	switch loadLog {
+	case "quiet", "summary", "verbose":
+	default:
+		log.Fatalf("unknown -load-log level %s", loadLog)
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		log.Fatal("-cert and -key must be given together")
+	}
+
+	if clientCA != "" && certFile == "" {
+		log.Fatal("-client-ca requires -cert and -key")
+	}
+
+	if tlsOptions.ciphers != "" && certFile == "" {
+		log.Fatal("-tls-ciphers requires -cert and -key")
+	}
+
+	// An address of unix:<path> is shorthand for only listening on
+	// the socket at path.
+	if strings.HasPrefix(addr, "unix:") {
+		if unixPath != "" {
+			log.Fatal("-unix can't be used with a unix: address")
+		}
+
+		unixPath = strings.TrimPrefix(addr, "unix:")
+		if unixPath == "" {
+			log.Fatal("no socket path given in -a")
+		}
+		addr = ""
+	}
+
+	if readOnly && backupInterval > 0 {
+		log.Fatal("-snapshot-interval can't be used with -read-only")
+	}
+
+	if limiter.rate > 0 && limiter.burst < 1 {
+		log.Fatal("-burst must be at least 1")
+	}
+
+	if memoryOnly {
+		store.file = ""
+	}
+
+	if backupDestructive && !persistent() {
+		log.Fatal("-backup-before-destructive needs a store file to write backups next to")
+	}
+
+	if persistent() {
+		err := checkStoreDir(mkdir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	setupDiskWriters(diskWriterLimit)
+	err := setupAudit(auditPath, auditNoops)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = setupAccessLog(accessPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if backendName != "json" {
+		open, ok := backends[backendName]
+		if !ok {
+			log.Fatalf("unknown backend %s", backendName)
+		}
+
+		// These work on the in-memory store, which other backends
+		// don't use.
+		for name, set := range map[string]bool{
+			"hard-max-bytes":    store.maxBytes > 0,
+			"seed":              seed != "",
+			"snapshot-interval": backupInterval > 0,
+		} {
+			if set {
+				log.Fatalf("-%s isn't supported by the %s backend", name, backendName)
+			}
+		}
+
+		backend, err = open(store.file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		restrictEndpoints()
+	} else if persistent() {
+		loadStart := time.Now()
+		in, err := ioutil.ReadFile(store.file)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Fatal(err)
+			}
+			logLoad(-1, 0)
+		} else {
+			err = json.Unmarshal(in, &store.values)
+			if err != nil {
+				log.Fatal(err)
+			}
+			logLoad(int64(len(in)), time.Since(loadStart))
+		}
+	}
+
+	startGrace(grace)
+
+	if seed != "" {
+		n, err := loadSeed(seed)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("seeded %d keys from %s", n, seed)
+		if n > 0 {
+			err = persist()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	indexExpiries()
+	removeExpired()
+	setupMetrics()
+	go sweep(sweepInterval)
+	if limiter.rate > 0 {
+		go pruneBuckets(time.Minute)
+	}
+	if flusher.interval > 0 && !readOnly {
+		go flush()
+	}
+
+	http.HandleFunc("/", handler)
+	srv := &http.Server{Addr: addr}
+	if certFile != "" {
+		srv.TLSConfig, err = serverTLSConfig(certFile, keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go reloadOnHangup()
+	}
+	done := shutdownOnSignal(srv, shutdownTimeout)
+	if backupInterval > 0 {
+		go backupEvery(backupInterval, done)
+	}
+
+	if unixPath != "" {
+		l, err := listenUnix(unixPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// With -cert and -key, the socket is served with TLS like
+		// the TCP address, so that -client-ca applies to it too.
+		serve := func() {
+			if certFile != "" {
+				checkServe(srv.ServeTLS(l, "", ""))
+			} else {
+				checkServe(srv.Serve(l))
+			}
+		}
+
+		if certFile != "" {
+			log.Println("listening on", unixPath, "with TLS")
+		} else {
+			log.Println("listening on", unixPath)
+		}
+		if addr == "" {
+			serve()
+			<-done
+			return
+		}
+
+		go serve()
+	}
+
+	if certFile != "" {
+		log.Println("listening on", addr, "with TLS")
+		checkServe(srv.ListenAndServeTLS("", ""))
+	} else {
+		log.Println("listening on", addr)
+		checkServe(srv.ListenAndServe())
+	}
+	<-done
 }
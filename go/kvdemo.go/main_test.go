@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// BenchmarkHandler measures a GET of a key through handler. Responses
+// are encoded straight to the ResponseWriter, so there's no buffer to
+// allocate for each one.
+func BenchmarkHandler(b *testing.B) {
+	resetStore(b)
+	setValue("key", "value")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest("GET", "/key", nil)
+		handler(httptest.NewRecorder(), req)
+	}
+}
+
+// TestWriteResponseUnencodable checks that a response that can't be
+// encoded is replaced by an error envelope that keeps its status.
+func TestWriteResponseUnencodable(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusInternalServerError} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/key", nil)
+		writeResponse(rec, req, &Response{
+			Status: status,
+			Data:   make(chan int),
+		})
+
+		if rec.Code != status {
+			t.Errorf("status is %d, want %d", rec.Code, status)
+		}
+
+		var r Response
+		err := json.Unmarshal(rec.Body.Bytes(), &r)
+		if err != nil {
+			t.Errorf("fallback envelope isn't valid JSON: %v (%q)", err, rec.Body.String())
+			continue
+		}
+
+		if r.Status != status || r.Data != "error forming response" {
+			t.Errorf("fallback envelope is %+v, want status %d", r, status)
+		}
+	}
+}
+
+// TestBodyLimit checks that the limit implied by -max-value-size only
+// applies to endpoints taking a single value, and that a body over it
+// is answered with the limit.
+func TestBodyLimit(t *testing.T) {
+	resetStore(t)
+	defer func() { maxValueSize = 0 }()
+	maxValueSize = 16
+
+	big := strings.Repeat("x", int(maxUploadSize()))
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", "/key", strings.NewReader(`{"value": "`+big+`"}`)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized upload returned %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	var r struct {
+		Data struct {
+			Error string `json:"error"`
+			Limit int64  `json:"limit"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Data.Error != "body_too_large" || r.Data.Limit != maxUploadSize() {
+		t.Errorf("oversized upload returned %+v, want body_too_large with a limit of %d", r.Data, maxUploadSize())
+	}
+
+	var pairs []string
+	for i := 0; len(pairs)*15 < len(big); i++ {
+		pairs = append(pairs, fmt.Sprintf(`"key%d": "value"`, i))
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", "/_mset", strings.NewReader(`{"pairs": {`+strings.Join(pairs, ", ")+"}}")))
+	if rec.Code != http.StatusOK {
+		t.Errorf("large /_mset returned %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+}
+
+// TestGetWithBody checks that the body of a GET is drained, and that
+// it's rejected with -reject-get-body.
+func TestGetWithBody(t *testing.T) {
+	resetStore(t)
+	setValue("key", "value")
+	defer func() { rejectGetBody = false }()
+
+	for _, reject := range []bool{false, true} {
+		rejectGetBody = reject
+		body := strings.NewReader(`{"ignored": true}`)
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/key", body))
+
+		want := http.StatusOK
+		if reject {
+			want = http.StatusBadRequest
+		}
+
+		if rec.Code != want {
+			t.Errorf("with -reject-get-body=%t, status is %d, want %d", reject, rec.Code, want)
+		}
+
+		if body.Len() != 0 {
+			t.Errorf("with -reject-get-body=%t, %d bytes of the body weren't read", reject, body.Len())
+		}
+	}
+}
+
+// TestIfMatchStaleETag checks that an If-Match ETag has to match the
+// key's current ETag in full: changing the expiry time changes the
+// ETag without bumping the version, and the old ETag must then fail.
+func TestIfMatchStaleETag(t *testing.T) {
+	resetStore(t)
+	post := func(body, match string) int {
+		req := httptest.NewRequest("POST", "/key", strings.NewReader(body))
+		if match != "" {
+			req.Header.Set("If-Match", match)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+	tag := func() string {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/key", nil))
+		return rec.Header().Get("ETag")
+	}
+
+	post(`{"value": "one", "ttl": 100}`, "")
+	old := tag()
+	post(`{"value": "one", "ttl": 500}`, "")
+	if tag() == old {
+		t.Fatal("changing the expiry time didn't change the ETag")
+	}
+
+	if code := post(`{"value": "two"}`, old); code != http.StatusPreconditionFailed {
+		t.Errorf("write with a stale ETag returned %d, want %d", code, http.StatusPreconditionFailed)
+	}
+
+	// The current ETag, a bare version tag and a version number all
+	// match.
+	for i, match := range []string{tag(), "v2", "3"} {
+		if code := post(fmt.Sprintf(`{"value": "%d"}`, i), match); code != http.StatusOK {
+			t.Errorf("write with If-Match %s returned %d, want %d", match, code, http.StatusOK)
+		}
+	}
+}
+
+// TestFieldOnNumericKey checks that a field can't be set on a numeric
+// key, which would leave it holding a string.
+func TestFieldOnNumericKey(t *testing.T) {
+	resetStore(t)
+	if _, _, err := numericOp("n", "set", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", "/n", strings.NewReader(`{"value": "abc", "field": "f"}`)))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("setting a field on a numeric key returned %d, want %d", rec.Code, http.StatusConflict)
+	}
+
+	if v, _ := getValue("n"); len(v.Fields) != 0 || v.Value != "1" {
+		t.Errorf("numeric key is now %+v", v)
+	}
+}
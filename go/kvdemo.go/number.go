@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+// typeNumber is the type of numeric keys.
+const typeNumber = "number"
+
+var (
+	// errTypeMismatch is returned when a numeric operation is
+	// attempted on a string key, or a numeric key is set to a
+	// string.
+	errTypeMismatch = errors.New("key is not numeric")
+
+	// errNotNumber is returned when an operand isn't a number.
+	errNotNumber = errors.New("operand is not a number")
+
+	// errUnknownOp is returned for an unsupported numeric
+	// operation.
+	errUnknownOp = errors.New("unknown numeric operation")
+
+	// errOverflow is returned when integer arithmetic overflows.
+	errOverflow = errors.New("integer overflow")
+
+	// errNotInteger is returned when a key being incremented
+	// doesn't hold an integer.
+	errNotInteger = errors.New("value is not an integer")
+)
+
+// A number is a numeric value. Integers are kept as integers so that
+// integer arithmetic is exact; a value becomes a float when either
+// operand is a float.
+type number struct {
+	isInt bool
+	i     int64
+	f     float64
+}
+
+// parseNumber parses s as an integer if possible, and as a float
+// otherwise.
+func parseNumber(s string) (number, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return number{isInt: true, i: i}, nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return number{}, errNotNumber
+	}
+	return number{f: f}, nil
+}
+
+func (n number) float() float64 {
+	if n.isInt {
+		return float64(n.i)
+	}
+	return n.f
+}
+
+func (n number) String() string {
+	if n.isInt {
+		return strconv.FormatInt(n.i, 10)
+	}
+	return strconv.FormatFloat(n.f, 'g', -1, 64)
+}
+
+// less reports whether n is less than m.
+func (n number) less(m number) bool {
+	if n.isInt && m.isInt {
+		return n.i < m.i
+	}
+	return n.float() < m.float()
+}
+
+// add returns n + m.
+func (n number) add(m number) (number, error) {
+	if n.isInt && m.isInt {
+		sum := n.i + m.i
+		if (m.i > 0 && sum < n.i) || (m.i < 0 && sum > n.i) {
+			return number{}, errOverflow
+		}
+		return number{isInt: true, i: sum}, nil
+	}
+	return number{f: n.float() + m.float()}, nil
+}
+
+// negate returns -n.
+func (n number) negate() (number, error) {
+	if n.isInt {
+		if n.i == math.MinInt64 {
+			return number{}, errOverflow
+		}
+		return number{isInt: true, i: -n.i}, nil
+	}
+	return number{f: -n.f}, nil
+}
+
+// apply returns the result of the numeric operation op on the current
+// value cur and operand. The operations are set, add, sub, min and max.
+func apply(op string, cur, operand number) (number, error) {
+	switch op {
+	case "set":
+		return operand, nil
+	case "add":
+		return cur.add(operand)
+	case "sub":
+		neg, err := operand.negate()
+		if err != nil {
+			return number{}, err
+		}
+		return cur.add(neg)
+	case "min":
+		if operand.less(cur) {
+			return operand, nil
+		}
+		return cur, nil
+	case "max":
+		if cur.less(operand) {
+			return operand, nil
+		}
+		return cur, nil
+	default:
+		return number{}, errUnknownOp
+	}
+}
+
+// numericOp atomically applies the numeric operation op to key with
+// the given operand, returning the resulting value. A missing key is
+// created as a numeric key; for add and sub, it starts at zero, and
+// for the others it takes the operand's value. An existing key must be
+// numeric, or errTypeMismatch is returned.
+func numericOp(key, op, operand string) (Value, bool, error) {
+	arg, err := parseNumber(operand)
+	if err != nil {
+		return Value{}, false, err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	cur := arg
+	if op == "add" || op == "sub" {
+		cur = number{isInt: true}
+	}
+
+	if v, ok := live(key); ok {
+		if v.Type != typeNumber {
+			return Value{}, false, errTypeMismatch
+		}
+
+		cur, err = parseNumber(v.Value)
+		if err != nil {
+			return Value{}, false, errTypeMismatch
+		}
+	}
+
+	result, err := apply(op, cur, arg)
+	if err != nil {
+		return Value{}, false, err
+	}
+
+	_, changed, err := storeValue(key, result.String(), typeNumber)
+	if err != nil {
+		return Value{}, false, err
+	}
+
+	return store.values[key].clone(), changed, nil
+}
+
+// getNumber returns the numeric value stored under key. It returns
+// false if the key isn't present, and errTypeMismatch if it isn't
+// numeric.
+func getNumber(key string) (Value, bool, error) {
+	v, ok := getValue(key)
+	if !ok {
+		return v, false, nil
+	}
+
+	if v.Type != typeNumber {
+		return v, true, errTypeMismatch
+	}
+	return v, true, nil
+}
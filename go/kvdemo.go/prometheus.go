@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// writePrometheus writes the metrics in the Prometheus text exposition
+// format.
+func writePrometheus(w http.ResponseWriter, metrics Metrics) {
+	metric := func(name, typ, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+		fmt.Fprintf(w, "%s %d\n", name, value)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric("kvdemo_store_size", "gauge", "Number of keys in the store.", int64(metrics.Size))
+	metric("kvdemo_store_bytes", "gauge", "Total size of the values in the store, in bytes.", metrics.Bytes)
+	metric("kvdemo_last_write_timestamp", "gauge", "Unix time of the last successful write of the store.", metrics.LastWrite)
+	metric("kvdemo_last_update_timestamp", "gauge", "Unix time of the last change to a key.", metrics.LastUpdate)
+	metric("kvdemo_write_errors_total", "counter", "Number of failed writes of the store.", metrics.WriteErrors)
+	metric("kvdemo_noop_writes_total", "counter", "Number of writes that didn't change the stored value.", metrics.NoopWrites)
+	metric("kvdemo_gets_total", "counter", "Number of requests to get a key.", metrics.Gets)
+	metric("kvdemo_sets_total", "counter", "Number of requests to set a key.", metrics.Sets)
+	metric("kvdemo_deletes_total", "counter", "Number of requests to delete a key.", metrics.Deletes)
+	metric("kvdemo_hits_total", "counter", "Number of gets that found the key.", metrics.Hits)
+	metric("kvdemo_misses_total", "counter", "Number of gets that didn't find the key.", metrics.Misses)
+	metric("kvdemo_start_time_seconds", "gauge", "Unix time at which the server was started.", started.Unix())
+	metric("kvdemo_uptime_seconds", "gauge", "Number of seconds the server has been running for.", int64(time.Since(started).Seconds()))
+}
+
+// prometheusMetrics serves the store metrics in the Prometheus text
+// exposition format. The JSON metrics remain available from the index.
+func prometheusMetrics(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	writePrometheus(w, getMetrics())
+	return nil
+}
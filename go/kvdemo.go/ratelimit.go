@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A bucket is the token bucket for one client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter rate limits requests from each client address.
+var limiter = struct {
+	lock sync.Mutex
+
+	// rate is the number of requests per second allowed from each
+	// client; if it's zero, requests aren't rate limited.
+	rate float64
+
+	// burst is the number of requests a client may make at once
+	// before being limited to the rate.
+	burst int
+
+	// reads controls whether reads are rate limited too.
+	reads bool
+
+	// buckets maps client addresses to their buckets.
+	buckets map[string]*bucket
+}{
+	burst:   10,
+	buckets: map[string]*bucket{},
+}
+
+// clientIP returns the IP address req was made from. Requests over a
+// Unix socket share the socket's address.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// rateLimited reports whether req is subject to rate limiting. Only
+// POST and DELETE requests are limited, unless reads are limited too.
+func rateLimited(req *http.Request) bool {
+	if limiter.rate <= 0 {
+		return false
+	}
+	return limiter.reads || req.Method == "POST" || req.Method == "DELETE"
+}
+
+// allow takes a token from the bucket for ip. If the bucket is empty,
+// it returns false along with how long it will be until a token is
+// available.
+func allow(ip string) (bool, time.Duration) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := time.Now()
+	b, ok := limiter.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: float64(limiter.burst)}
+		limiter.buckets[ip] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limiter.rate
+		if b.tokens > float64(limiter.burst) {
+			b.tokens = float64(limiter.burst)
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / limiter.rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+
+	b.tokens--
+	return true, 0
+}
+
+// allowRequest applies the rate limit to req, reporting whether it may
+// proceed and, if not, how long the client should wait.
+func allowRequest(req *http.Request) (bool, time.Duration) {
+	if !rateLimited(req) {
+		return true, 0
+	}
+	return allow(clientIP(req))
+}
+
+// tooManyRequests returns the response for a request that was rate
+// limited; the client is told to retry after wait.
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) *Response {
+	w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(wait.Seconds()))))
+	return &Response{
+		Status: http.StatusTooManyRequests,
+		Data:   "too many requests; try again later",
+	}
+}
+
+// pruneBuckets periodically removes the buckets of clients that have
+// been idle long enough for their buckets to refill, as they're no
+// different from a new bucket.
+func pruneBuckets(interval time.Duration) {
+	for range time.Tick(interval) {
+		full := time.Duration(float64(limiter.burst) / limiter.rate * float64(time.Second))
+		limiter.lock.Lock()
+		for ip, b := range limiter.buckets {
+			if time.Since(b.last) >= full {
+				delete(limiter.buckets, ip)
+			}
+		}
+		limiter.lock.Unlock()
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import "net/http"
+
+// readOnly causes every request that could change the store to be
+// rejected, and stops the store from being written to disk.
+var readOnly bool
+
+// readEndpoints lists the POST endpoints that only read the store,
+// which remain available in read-only mode. Backups aren't, as nothing
+// is written to disk in this mode.
+var readEndpoints = map[string]bool{
+	"_diffdump": true,
+	"_mget":     true,
+	"_rpc":      true,
+}
+
+// mutates reports whether req, made to the reserved or key path, could
+// change the store. GET and HEAD requests never do.
+func mutates(req *http.Request, path string) bool {
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return false
+	}
+
+	if _, arg, ok := lookupEndpoint(path); ok {
+		return !readEndpoints[path[:len(path)-len(arg)]]
+	}
+	return true
+}
+
+// rejectWrite returns the response for a request that would change the
+// store while the server is read-only.
+func rejectWrite(req *http.Request) *Response {
+	return &Response{
+		Status: http.StatusMethodNotAllowed,
+		Data:   "the server is read-only; " + req.Method + " requests that change the store aren't allowed",
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// rotation controls the rotation of the store file by size.
+var rotation = struct {
+	// size is the size in bytes above which the store file is
+	// rotated; 0 disables rotation.
+	size int64
+
+	// keep is the number of rotated files to keep.
+	keep int
+}{
+	keep: 5,
+}
+
+// rotatedName returns the name of the nth rotated store file.
+func rotatedName(n int) string {
+	return fmt.Sprintf("%s.%d", store.file, n)
+}
+
+// rotateStore rotates the store file if it's larger than the rotation
+// size. The rotated files are numbered from 1 (the most recent) up to
+// the number kept; older ones are removed. The current store file is
+// linked into the series rather than moved, so it's never missing;
+// loading always reads the current file.
+//
+// The store file is rewritten in full on each write, so once the store
+// itself is larger than the rotation size, each write rotates it.
+func rotateStore() error {
+	if rotation.size <= 0 {
+		return nil
+	}
+
+	fi, err := os.Stat(store.file)
+	if err != nil || fi.Size() <= rotation.size {
+		return err
+	}
+
+	err = os.Remove(rotatedName(rotation.keep))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for n := rotation.keep - 1; n >= 1; n-- {
+		err = os.Rename(rotatedName(n), rotatedName(n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if rotation.keep < 1 {
+		return nil
+	}
+	return os.Link(store.file, rotatedName(1))
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// JSON-RPC 2.0 error codes. The codes below -32000 are defined by the
+// specification; the others are specific to kvdemo.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcKeyNotFound    = -32001
+	rpcStoreFull      = -32002
+	rpcTypeMismatch   = -32003
+	rpcReadOnly       = -32004
+	rpcListTooLarge   = -32005
+)
+
+// An rpcRequest is a single JSON-RPC 2.0 request. A request without an
+// ID is a notification, and no response is sent for it.
+type rpcRequest struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// An RPCError is the error object in a JSON-RPC response. It is
+// exported so that it may be serialised by the JSON package.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// An RPCResponse is a JSON-RPC 2.0 response. It is exported so that it
+// may be serialised by the JSON package.
+type RPCResponse struct {
+	Version string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcParams are the parameters accepted by the kv.* methods; each
+// method uses the subset it needs.
+type rpcParams struct {
+	Key    *string `json:"key"`
+	Value  *string `json:"value"`
+	Prefix string  `json:"prefix"`
+}
+
+// An rpcMethod implements one of the JSON-RPC methods.
+type rpcMethod func(req *http.Request, params *rpcParams) (interface{}, *RPCError)
+
+// rpcMethods maps JSON-RPC method names to their implementations.
+var rpcMethods = map[string]rpcMethod{
+	"kv.delete": rpcDelete,
+	"kv.get":    rpcGet,
+	"kv.list":   rpcList,
+	"kv.set":    rpcSet,
+}
+
+// rpcGet returns the value stored under the key parameter.
+func rpcGet(req *http.Request, params *rpcParams) (interface{}, *RPCError) {
+	if params.Key == nil {
+		return nil, &RPCError{rpcInvalidParams, "missing key"}
+	}
+
+	value, ok := backend.Get(*params.Key)
+	if !ok {
+		return nil, &RPCError{rpcKeyNotFound, fmt.Sprintf("key '%s' doesn't exist in the store", *params.Key)}
+	}
+
+	return value.public(), nil
+}
+
+// rpcSet stores the value parameter under the key parameter, writing
+// the store to disk if the value changed. The result reports whether
+// the value changed.
+func rpcSet(req *http.Request, params *rpcParams) (interface{}, *RPCError) {
+	if readOnly {
+		return nil, &RPCError{rpcReadOnly, "the server is read-only"}
+	}
+
+	if params.Key == nil || params.Value == nil {
+		return nil, &RPCError{rpcInvalidParams, "key and value are required"}
+	}
+
+	if err := validateKey(*params.Key); err != nil {
+		return nil, &RPCError{rpcInvalidParams, err.Error()}
+	}
+
+	if tooLarge(*params.Value) {
+		return nil, &RPCError{rpcInvalidParams, fmt.Sprintf("values may be at most %d bytes", maxValueSize)}
+	}
+
+	err := validateValue(*params.Key, *params.Value)
+	if err != nil {
+		return nil, &RPCError{rpcInvalidParams, err.Error()}
+	}
+
+	_, changed, err := backend.Set(*params.Key, *params.Value)
+	auditWrite(req.RemoteAddr, "set", *params.Key, changed)
+	switch err {
+	case nil:
+	case errStoreFull:
+		return nil, &RPCError{rpcStoreFull, err.Error()}
+	case errTypeMismatch:
+		return nil, &RPCError{rpcTypeMismatch, err.Error()}
+	default:
+		return nil, &RPCError{rpcInternalError, "server encountered an error storing the key / value pairs"}
+	}
+
+	if changed {
+		err = persistKey(*params.Key)
+		if err != nil {
+			return nil, &RPCError{rpcInternalError, "server encountered an error storing the key / value pairs"}
+		}
+	}
+
+	return map[string]bool{"changed": changed}, nil
+}
+
+// rpcDelete removes the key parameter from the store. The result
+// reports whether the key was present.
+func rpcDelete(req *http.Request, params *rpcParams) (interface{}, *RPCError) {
+	if readOnly {
+		return nil, &RPCError{rpcReadOnly, "the server is read-only"}
+	}
+
+	if params.Key == nil {
+		return nil, &RPCError{rpcInvalidParams, "missing key"}
+	}
+
+	deleted := backend.Delete(*params.Key)
+	auditWrite(req.RemoteAddr, "delete", *params.Key, deleted)
+	if deleted {
+		err := persist()
+		if err != nil {
+			return nil, &RPCError{rpcInternalError, "server encountered an error storing the key / value pairs"}
+		}
+	}
+
+	return map[string]bool{"deleted": deleted}, nil
+}
+
+// rpcList returns the sorted keys beginning with the prefix parameter,
+// or every key if it's not given.
+func rpcList(req *http.Request, params *rpcParams) (interface{}, *RPCError) {
+	keys, err := backend.List(params.Prefix)
+	switch err {
+	case nil:
+	case errListTooLarge:
+		return nil, &RPCError{rpcListTooLarge, listTooLarge()}
+	default:
+		return nil, &RPCError{rpcInternalError, "server encountered an error listing the keys"}
+	}
+
+	return keys, nil
+}
+
+// rpcCall runs a single JSON-RPC request. It returns nil if the
+// request is a notification.
+func rpcCall(req *http.Request, raw json.RawMessage) *RPCResponse {
+	var call rpcRequest
+	err := json.Unmarshal(raw, &call)
+	if err != nil || call.Version != "2.0" || call.Method == "" {
+		return &RPCResponse{
+			Version: "2.0",
+			Error:   &RPCError{rpcInvalidRequest, "invalid request"},
+			ID:      json.RawMessage("null"),
+		}
+	}
+
+	resp := &RPCResponse{Version: "2.0", ID: call.ID}
+	method, ok := rpcMethods[call.Method]
+	if !ok {
+		resp.Error = &RPCError{rpcMethodNotFound, "method not found: " + call.Method}
+	} else {
+		var params rpcParams
+		if len(call.Params) > 0 && json.Unmarshal(call.Params, &params) != nil {
+			resp.Error = &RPCError{rpcInvalidParams, "params must be an object"}
+		} else {
+			resp.Result, resp.Error = method(req, &params)
+		}
+	}
+
+	if call.ID == nil {
+		return nil
+	}
+	return resp
+}
+
+// writeRPC writes a JSON-RPC response body. A nil body results in an
+// empty response, as required for notifications.
+func writeRPC(w http.ResponseWriter, body interface{}) {
+	if body == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// rpcEndpoint serves JSON-RPC 2.0 requests, including batches, at
+// /_rpc. The methods operate on the same store as the HTTP API:
+//
+//   - kv.get {"key": <key>} returns the Value stored under key.
+//   - kv.set {"key": <key>, "value": <value>} updates the value.
+//   - kv.delete {"key": <key>} removes the key.
+//   - kv.list {"prefix": <prefix>} lists the keys beginning with
+//     prefix; the prefix is optional.
+//
+// Errors are reported as JSON-RPC errors rather than with HTTP status
+// codes. If the server is read-only, kv.set and kv.delete fail.
+func rpcEndpoint(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	in, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return badBody(err)
+	}
+
+	in = bytes.TrimSpace(in)
+	if !json.Valid(in) {
+		writeRPC(w, &RPCResponse{
+			Version: "2.0",
+			Error:   &RPCError{rpcParseError, "parse error"},
+			ID:      json.RawMessage("null"),
+		})
+		return nil
+	}
+
+	if in[0] != '[' {
+		resp := rpcCall(req, in)
+		if resp == nil {
+			writeRPC(w, nil)
+		} else {
+			writeRPC(w, resp)
+		}
+		return nil
+	}
+
+	var batch []json.RawMessage
+	json.Unmarshal(in, &batch)
+	if len(batch) == 0 {
+		writeRPC(w, &RPCResponse{
+			Version: "2.0",
+			Error:   &RPCError{rpcInvalidRequest, "empty batch"},
+			ID:      json.RawMessage("null"),
+		})
+		return nil
+	}
+
+	var resps []*RPCResponse
+	for _, raw := range batch {
+		if resp := rpcCall(req, raw); resp != nil {
+			resps = append(resps, resp)
+		}
+	}
+
+	if len(resps) == 0 {
+		writeRPC(w, nil)
+	} else {
+		writeRPC(w, resps)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A frozen is a read-only copy of the store taken for a snapshot
+// token.
+type frozen struct {
+	values  map[string]Value
+	taken   time.Time
+	expires time.Time
+}
+
+// get returns the value stored under key when the snapshot was taken.
+// A value that had expired by then is treated as absent.
+func (f *frozen) get(key string) (Value, bool) {
+	v, ok := f.values[key]
+	if !ok || v.expired(f.taken.Unix()) {
+		return Value{}, false
+	}
+	return v, true
+}
+
+// snapshots holds the snapshots that clients have taken, by token.
+var snapshots = struct {
+	lock sync.Mutex
+
+	// ttl is how long a snapshot can be read from after it's
+	// taken.
+	ttl time.Duration
+
+	// max is the most snapshots that may be held at once,
+	// including those being taken; 0 means there's no limit.
+	max int
+
+	// taking is the number of snapshots being copied.
+	taking int
+
+	frozen map[string]*frozen
+}{
+	ttl:    time.Minute,
+	max:    16,
+	frozen: map[string]*frozen{},
+}
+
+// errTooManySnapshots is returned by takeSnapshot when the limit on
+// the number of snapshots has been reached.
+var errTooManySnapshots = errors.New("too many snapshots")
+
+// pruneSnapshots drops the expired snapshots. The caller must hold the
+// snapshots lock.
+func pruneSnapshots(now time.Time) {
+	for token, f := range snapshots.frozen {
+		if now.After(f.expires) {
+			delete(snapshots.frozen, token)
+		}
+	}
+}
+
+// takeSnapshot freezes a copy of the store, returning the token that
+// reads from it. Each snapshot is a full copy of the store, so if the
+// limit on the number of snapshots has been reached, no copy is made
+// and errTooManySnapshots is returned.
+func takeSnapshot() (string, *frozen, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(b[:])
+
+	snapshots.lock.Lock()
+	pruneSnapshots(time.Now())
+	if snapshots.max > 0 && len(snapshots.frozen)+snapshots.taking >= snapshots.max {
+		snapshots.lock.Unlock()
+		return "", nil, errTooManySnapshots
+	}
+	snapshots.taking++
+	snapshots.lock.Unlock()
+
+	now := time.Now()
+	f := &frozen{
+		values:  snapshot(),
+		taken:   now,
+		expires: now.Add(snapshots.ttl),
+	}
+
+	snapshots.lock.Lock()
+	defer snapshots.lock.Unlock()
+
+	snapshots.taking--
+	snapshots.frozen[token] = f
+	return token, f, nil
+}
+
+// getSnapshot returns the snapshot for token, if it exists and hasn't
+// expired.
+func getSnapshot(token string) (*frozen, bool) {
+	snapshots.lock.Lock()
+	defer snapshots.lock.Unlock()
+
+	pruneSnapshots(time.Now())
+	f, ok := snapshots.frozen[token]
+	return f, ok
+}
+
+// newSnapshot takes a snapshot of the store and returns its token,
+// along with when the snapshot expires. Passing the token in the
+// snapshot query parameter of a GET for a key reads the key as it was
+// when the snapshot was taken. If the server already holds as many
+// snapshots as -max-snapshots allows, an HTTP Service Unavailable is
+// returned.
+func newSnapshot(w http.ResponseWriter, req *http.Request, arg string) *Response {
+	token, f, err := takeSnapshot()
+	if err == errTooManySnapshots {
+		return &Response{
+			Status: http.StatusServiceUnavailable,
+			Data:   "too many snapshots are held; try again once one has expired",
+		}
+	} else if err != nil {
+		return &Response{
+			Status: http.StatusInternalServerError,
+			Data:   "couldn't create a snapshot token",
+		}
+	}
+
+	return &Response{
+		Status: http.StatusOK,
+		Data: map[string]interface{}{
+			"token":      token,
+			"expires_at": f.expires.Unix(),
+		},
+	}
+}
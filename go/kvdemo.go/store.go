@@ -2,18 +2,54 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Value contains some value contained in the KV store. This is exported
 // so that it may be used with the JSON library.
+//
+// A value may also hold a set of named fields, each of which is a
+// Value in its own right and is versioned independently. Updating a
+// field bumps the Updated timestamp of the containing value but not
+// its version.
 type Value struct {
-	Updated int64  // Unix timestamp of last update.
-	Version int    // Incremented on each write.
-	Value   string // The actual value.
+	Updated int64             // Unix timestamp of last update.
+	Version int               // Incremented on each write.
+	Value   string            // The actual value.
+	Fields  map[string]*Value `json:",omitempty"` // Named sub-values.
+
+	// Filename is the name the value is served under when it is
+	// downloaded.
+	Filename string `json:",omitempty"`
+
+	// Type is typeNumber for numeric keys, and empty for string
+	// keys.
+	Type string `json:",omitempty"`
+
+	// ExpiresAt is the Unix timestamp at which the value expires;
+	// 0 means it never expires.
+	ExpiresAt int64 `json:",omitempty"`
+
+	// Epoch counts the times the version has been reset to 1 by
+	// -max-version-reset.
+	Epoch int `json:",omitempty"`
+
+	// History holds the previous versions of the value, oldest
+	// first, if the server was started with -history.
+	History []HistoryEntry `json:",omitempty"`
 }
 
 // update determines whether the new value is different from the current
@@ -30,12 +66,72 @@ func (v *Value) update(s string) bool {
 	return false
 }
 
+// clone returns a copy of v that shares no state with it, so that it
+// may be used after the store lock is released.
+func (v *Value) clone() Value {
+	c := *v
+	if v.History != nil {
+		c.History = append([]HistoryEntry(nil), v.History...)
+	}
+
+	if v.Fields != nil {
+		c.Fields = make(map[string]*Value, len(v.Fields))
+		for name, f := range v.Fields {
+			fc := f.clone()
+			c.Fields[name] = &fc
+		}
+	}
+	return c
+}
+
+// size returns the number of bytes of value data held by v, including
+// its fields.
+func (v *Value) size() int64 {
+	n := int64(len(v.Value))
+	for _, f := range v.Fields {
+		n += int64(len(f.Value))
+	}
+	return n
+}
+
+// A SizeHistogram counts the values in the store by size, using fixed
+// buckets of under 1 KiB, under 10 KiB, under 100 KiB, and 100 KiB or
+// more. It is exported so that it may be serialised by the JSON
+// package.
+type SizeHistogram struct {
+	Under1K   int `json:"lt_1k"`
+	Under10K  int `json:"lt_10k"`
+	Under100K int `json:"lt_100k"`
+	Over100K  int `json:"ge_100k"`
+}
+
+// add adds n to the bucket for values of the given size; n may be
+// negative to remove values.
+func (h *SizeHistogram) add(size int64, n int) {
+	switch {
+	case size < 1<<10:
+		h.Under1K += n
+	case size < 10<<10:
+		h.Under10K += n
+	case size < 100<<10:
+		h.Under100K += n
+	default:
+		h.Over100K += n
+	}
+}
+
 // Metrics contains basic health check information about the server. This
 // is exported so that it may be serialised by the JSON package.
 type Metrics struct {
 	// Size of key store.
 	Size int `json:"size"`
 
+	// Total size of the values in the store, in bytes.
+	Bytes int64 `json:"bytes"`
+
+	// Distribution of the sizes of the values in the store.
+	Sizes SizeHistogram `json:"size_histogram"`
+
 	// Last time the store was successfully written.
 	LastWrite int64 `json:"last_write"`
 
@@ -44,27 +140,115 @@ type Metrics struct {
 
 	// If a write error has occurred, it will be presented here.
 	WriteError string `json:"write_error"`
+
+	// Number of failed writes of the store.
+	WriteErrors int64 `json:"write_errors"`
+
+	// Number of writes that didn't change the stored value.
+	NoopWrites int64 `json:"noop_writes"`
+
+	// Number of writes of the store waiting for a disk writer
+	// slot.
+	WriteQueue int64 `json:"write_queue"`
+
+	// Number of requests to get, set and delete keys.
+	Gets    int64 `json:"gets"`
+	Sets    int64 `json:"sets"`
+	Deletes int64 `json:"deletes"`
+
+	// Number of gets that found the key, and that didn't.
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+
+	// When the server was started, and how long it has been
+	// running for, in seconds. These are filled in when the
+	// metrics are served.
+	StartTime     int64 `json:"start_time"`
+	UptimeSeconds int64 `json:"uptime_seconds"`
+
+	// The largest value that may be written, in bytes, if the
+	// server was started with -max-value-size.
+	MaxValueSize int64 `json:"max_value_size,omitempty"`
+
+	// Set if the store is only kept in memory, in which case it's
+	// never written and LastWrite stays at 0.
+	MemoryOnly bool `json:"memory_only,omitempty"`
+
+	// Set if the server was started with -read-only, in which case
+	// writes are rejected and the store file is never written.
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	// Set if the store is empty and the server was started with
+	// -report-empty.
+	Empty bool `json:"empty,omitempty"`
+
+	// Set if the store was too busy to get current metrics, and
+	// these are the last metrics that could be obtained.
+	Stale bool `json:"stale,omitempty"`
 }
 
 // store is the global data structure containing the data store.
 var store = struct {
-	// lock is used to prevent concurrent writes.
-	lock sync.Mutex
+	// lock is used to prevent concurrent writes; reads only need
+	// the read lock.
+	lock sync.RWMutex
 
 	// values contains the actual key/value pairs.
 	values map[string]*Value
 
-	// file contains the path to the store file.
+	// file contains the path to the store file. If it's empty,
+	// the store is only kept in memory.
 	file string
 
 	// metrics tracks information about the store.
 	metrics Metrics
+
+	// graceUntil is the end of the startup grace period, during
+	// which writes to disk are deferred.
+	graceUntil time.Time
+
+	// dirty is set when a write to disk has been deferred.
+	dirty bool
+
+	// maxBytes is the hard limit on the total size of the values
+	// in the store; 0 means there's no limit.
+	maxBytes int64
 }{
 	// values is initialised to an empty map; this is because an
 	// attempt to unmarshal JSON into a nil map will panic.
 	values: map[string]*Value{},
 }
 
+// checkStoreDir makes sure the directory that will hold the store file
+// exists, so that a missing directory is reported at startup rather
+// than on the first write. If create is true, a missing directory is
+// created.
+func checkStoreDir(create bool) error {
+	dir := filepath.Dir(store.file)
+	fi, err := os.Stat(dir)
+	if err == nil {
+		if !fi.IsDir() {
+			return fmt.Errorf("store directory %s is not a directory", dir)
+		}
+		return nil
+	}
+
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	if !create {
+		return fmt.Errorf("store directory %s doesn't exist (use -mkdir to create it)", dir)
+	}
+
+	return os.MkdirAll(dir, 0755)
+}
+
+// persistent reports whether the store is written to disk.
+func persistent() bool {
+	return store.file != ""
+}
+
 // setupMetrics populates the store's metrics field. This has to be
 // done after the store file is loaded, and therefore can't be done
 // in an init() function.
@@ -73,77 +257,1301 @@ var store = struct {
 // time across all the values in the key store. The last write time is
 // set to the modified time on the store file, and if any error occurs
 // trying to read the file (apart from ENOENT), it will go in the last
-// write error field.
+// write error field. If the store is only kept in memory, the metrics
+// say so instead.
 func setupMetrics() {
 	store.metrics.Size = len(store.values)
 
+	store.metrics.Bytes = 0
+	store.metrics.Sizes = SizeHistogram{}
 	for _, v := range store.values {
+		store.metrics.Bytes += v.size()
+		store.metrics.Sizes.add(v.size(), 1)
 		if v.Updated > store.metrics.LastUpdate {
 			store.metrics.LastUpdate = v.Updated
 		}
 	}
 
-	fi, err := os.Stat(store.file)
-	if err != nil {
+	if !persistent() {
+		store.metrics.MemoryOnly = true
+	} else if fi, err := os.Stat(store.file); err != nil {
 		if !os.IsNotExist(err) {
 			store.metrics.WriteError = err.Error()
 		}
 	} else {
 		store.metrics.LastWrite = fi.ModTime().Unix()
 	}
+
+	lastMetrics.metrics = store.metrics
+}
+
+// errStoreFull is returned when a write would take the store over its
+// size limit.
+var errStoreFull = errors.New("store is full")
+
+// reserve accounts for a change of delta bytes in the size of the
+// store's values. A write that would grow the store beyond its limit
+// is rejected with errStoreFull; writes that don't grow the store are
+// always allowed. The caller must hold the store lock.
+func reserve(delta int64) error {
+	if store.maxBytes > 0 && delta > 0 && store.metrics.Bytes+delta > store.maxBytes {
+		return errStoreFull
+	}
+
+	store.metrics.Bytes += delta
+	return nil
+}
+
+// counters holds the metrics that are updated atomically rather than
+// under the store lock.
+var counters struct {
+	gets, sets, deletes, hits, misses int64
+}
+
+// countGet counts a request to get a key, and whether it was found.
+func countGet(found bool) {
+	atomic.AddInt64(&counters.gets, 1)
+	if found {
+		atomic.AddInt64(&counters.hits, 1)
+	} else {
+		atomic.AddInt64(&counters.misses, 1)
+	}
+}
+
+// loadCounters fills in the metrics that aren't kept under the store
+// lock.
+func (m *Metrics) loadCounters() {
+	m.WriteQueue = atomic.LoadInt64(&diskWriters.waiting)
+	m.Gets = atomic.LoadInt64(&counters.gets)
+	m.Sets = atomic.LoadInt64(&counters.sets)
+	m.Deletes = atomic.LoadInt64(&counters.deletes)
+	m.Hits = atomic.LoadInt64(&counters.hits)
+	m.Misses = atomic.LoadInt64(&counters.misses)
+}
+
+// getMetrics returns a copy of the store's metrics.
+func getMetrics() Metrics {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	m := store.metrics
+	m.loadCounters()
+	return m
+}
+
+// lastWriteError returns the error from the last write of the store,
+// or an empty string if it succeeded.
+func lastWriteError() string {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return store.metrics.WriteError
+}
+
+// metricsTryLock is how long to try to get current metrics for before
+// settling for the last metrics obtained; if it's zero, getting the
+// metrics waits for the store lock.
+var metricsTryLock time.Duration
+
+// lastMetrics holds the last metrics returned by getMetrics, which are
+// returned as stale metrics if the store is too busy.
+var lastMetrics struct {
+	lock    sync.Mutex
+	metrics Metrics
+}
+
+// tryRLockStore attempts to read-lock the store for up to d, returning
+// false if it couldn't.
+func tryRLockStore(d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	for !store.lock.TryRLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// getMetricsOrStale returns the store's metrics. If the store lock
+// can't be acquired within metricsTryLock, it returns the last metrics
+// obtained instead, marked as stale. The last metrics are only locked
+// to read or update them, so concurrent callers wait for the store
+// independently rather than one after another.
+func getMetricsOrStale() Metrics {
+	if metricsTryLock <= 0 {
+		return getMetrics()
+	}
+
+	if !tryRLockStore(metricsTryLock) {
+		lastMetrics.lock.Lock()
+		stale := lastMetrics.metrics
+		lastMetrics.lock.Unlock()
+
+		stale.Stale = true
+		return stale
+	}
+
+	m := store.metrics
+	store.lock.RUnlock()
+	m.loadCounters()
+
+	lastMetrics.lock.Lock()
+	lastMetrics.metrics = m
+	lastMetrics.lock.Unlock()
+	return m
+}
+
+// metricsCache holds a recent copy of the store's metrics, so that
+// frequent requests for the metrics don't contend with writes for the
+// store lock.
+var metricsCache = struct {
+	lock sync.Mutex
+
+	// ttl is how long a copy of the metrics is reused for; if
+	// it's zero, the metrics aren't cached.
+	ttl time.Duration
+
+	// taken is when the cached copy was taken.
+	taken time.Time
+
+	metrics Metrics
+}{}
+
+// cachedMetrics returns the store's metrics, reusing the cached copy if
+// it's recent enough. Otherwise, it calls getMetricsOrStale.
+func cachedMetrics() Metrics {
+	if metricsCache.ttl <= 0 {
+		return getMetricsOrStale()
+	}
+
+	metricsCache.lock.Lock()
+	defer metricsCache.lock.Unlock()
+
+	if time.Since(metricsCache.taken) >= metricsCache.ttl {
+		metricsCache.metrics = getMetricsOrStale()
+		metricsCache.taken = time.Now()
+	}
+
+	return metricsCache.metrics
+}
+
+// resized updates the size histogram after a change to v. If v was
+// already in the store, oldSize is its size before the change. The
+// caller must hold the store lock.
+func resized(existed bool, oldSize int64, v *Value) {
+	if existed {
+		store.metrics.Sizes.add(oldSize, -1)
+	}
+	store.metrics.Sizes.add(v.size(), 1)
 }
 
 // setValue updates a value in the store and updates the metrics as
-// needed. It returns true if the value was changed, and false otherwise.
-func setValue(key, value string) bool {
+// needed. It returns the previous value, or nil if the key is new, and
+// true if the value was changed, and false otherwise. If the change
+// would exceed the store's size limit, the value isn't changed and
+// errStoreFull is returned. A numeric key may only be set to a number;
+// any other value is rejected with errTypeMismatch.
+func setValue(key, value string) (*Value, bool, error) {
 	store.lock.Lock()
 	defer store.lock.Unlock()
 
-	v := store.values[key]
-	if v == nil {
-		v = &Value{}
+	err := checkType(key, value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return storeValue(key, value, "")
+}
+
+// errVersionConflict is returned by setValueCAS when the key's version
+// isn't the expected one.
+var errVersionConflict = errors.New("version conflict")
+
+// errVersionReset is returned by setValueCAS when the key's version has
+// been reset since the expected version was read.
+var errVersionReset = errors.New("version reset")
+
+// setValueCAS is like setValue, but only writes the value if the key
+// meets the precondition want: it must be at the expected version in
+// the expected epoch, and if want has an ETag, the key's current ETag
+// must be the same. If the epoch differs, it returns errVersionReset,
+// and otherwise, if the key doesn't match, errVersionConflict. A
+// missing key has version 0 and no ETag. The comparison and the write
+// are made under the same lock, so concurrent writers using the same
+// expected version can't both succeed. Checking the epoch means that a
+// version from before a reset by -max-version-reset doesn't match the
+// reused version after it.
+func setValueCAS(key, value string, want precondition) (*Value, bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	current, epoch, tag := 0, 0, ""
+	if v, ok := live(key); ok {
+		current, epoch, tag = v.Version, v.Epoch, etag(*v)
+	}
+
+	if epoch != want.epoch {
+		return nil, false, errVersionReset
+	}
+
+	if current != want.version || (want.tag != "" && tag != want.tag) {
+		return nil, false, errVersionConflict
+	}
+
+	err := checkType(key, value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return storeValue(key, value, "")
+}
+
+// checkType returns errTypeMismatch if key is numeric and value isn't
+// a number. The caller must hold the store lock.
+func checkType(key, value string) error {
+	if v, ok := live(key); ok && v.Type == typeNumber {
+		if _, err := parseNumber(value); err != nil {
+			return errTypeMismatch
+		}
+	}
+	return nil
+}
+
+// versionCap controls what happens when a key's version grows too
+// large.
+var versionCap = struct {
+	// max is the highest version a key should reach; 0 means
+	// there's no limit.
+	max int
+
+	// reset causes a key that goes past max to have its version
+	// reset to 1. Otherwise, a warning is logged.
+	reset bool
+}{}
+
+// capVersion checks v, which has just been updated, against the
+// version cap. A reset is logged so that it can be told apart from a
+// key that was deleted and recreated. Resetting means that a version
+// may be reused, so it also bumps the key's epoch, which is part of
+// its ETag: a conditional write with a version from before the reset
+// fails rather than matching the reused version. The caller must hold
+// the store lock.
+func capVersion(key string, v *Value) {
+	if versionCap.max <= 0 || v.Version <= versionCap.max {
+		return
+	}
+
+	if versionCap.reset {
+		log.Printf("key %s reached version %d; resetting its version to 1", logKey(key), v.Version)
+		v.Version = 1
+		v.Epoch++
+	} else if v.Version == versionCap.max+1 {
+		log.Printf("key %s has passed the maximum version of %d", logKey(key), versionCap.max)
+	}
+}
+
+// storeValue does the work of setValue. If the key is new, it is
+// created with the type typ. The caller must hold the store lock.
+func storeValue(key, value, typ string) (*Value, bool, error) {
+	var prev *Value
+	v, existed := live(key)
+	if existed {
+		c := v.clone()
+		prev = &c
+	} else {
+		v = &Value{Type: typ}
+	}
+	oldSize := v.size()
+
+	if value != v.Value {
+		err := reserve(int64(len(value) - len(v.Value)))
+		if err != nil {
+			return prev, false, err
+		}
+		v.remember()
 	}
 
 	if v.update(value) {
+		capVersion(key, v)
 		store.values[key] = v
+		resized(existed, oldSize, v)
 		store.metrics.LastUpdate = time.Now().Unix()
 		store.metrics.Size = len(store.values)
+		notify(key, v)
+		return prev, true, nil
+	}
+
+	store.metrics.NoopWrites++
+	return prev, false, nil
+}
+
+// setValues sets each key in pairs to its value, all under the same
+// lock. Either every pair is applied, or none are: if any key is
+// numeric and its new value isn't a number, errTypeMismatch is returned
+// along with that key, and if the changes would take the store over
+// its size limit, errStoreFull is returned. Otherwise, the returned map
+// reports whether each key was changed.
+func setValues(pairs map[string]string) (map[string]bool, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	keys := make([]string, 0, len(pairs))
+	deltas := make(map[string]int64, len(pairs))
+	var total int64
+	for key, value := range pairs {
+		err := checkType(key, value)
+		if err != nil {
+			return nil, key, err
+		}
+
+		delta := int64(len(value))
+		if v, ok := live(key); ok {
+			delta -= int64(len(v.Value))
+		}
+
+		keys = append(keys, key)
+		deltas[key] = delta
+		total += delta
+	}
+
+	if store.maxBytes > 0 && total > 0 && store.metrics.Bytes+total > store.maxBytes {
+		return nil, "", errStoreFull
+	}
+
+	// Applying the pairs that shrink the store first means that the
+	// store never grows by more than the total, which has already
+	// been checked, so none of them can fail.
+	sort.Slice(keys, func(i, j int) bool {
+		if deltas[keys[i]] != deltas[keys[j]] {
+			return deltas[keys[i]] < deltas[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	changed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		_, changed[key], _ = storeValue(key, pairs[key], "")
+	}
+	return changed, "", nil
+}
+
+// A conflictPolicy decides whether an imported value, in, replaces
+// the value cur that's already in the store under the same key.
+type conflictPolicy func(cur, in *Value) bool
+
+// conflictPolicies maps the names accepted by the conflict parameter of
+// /_import to their policies. Where the policy compares the values and
+// they're tied, the existing value is kept.
+//
+//   - incoming: the imported value always wins. This is the default.
+//   - existing: the value in the store always wins, so only new keys
+//     are imported.
+//   - version: the value with the higher version wins. Versions are
+//     compared by epoch first, so a value whose version has been
+//     reset is newer than one that hasn't.
+//   - timestamp: the value that was updated most recently wins.
+var conflictPolicies = map[string]conflictPolicy{
+	"incoming": func(cur, in *Value) bool {
 		return true
+	},
+	"existing": func(cur, in *Value) bool {
+		return false
+	},
+	"version": func(cur, in *Value) bool {
+		if in.Epoch != cur.Epoch {
+			return in.Epoch > cur.Epoch
+		}
+		return in.Version > cur.Version
+	},
+	"timestamp": func(cur, in *Value) bool {
+		return in.Updated > cur.Updated
+	},
+}
+
+// importValues merges values, a dump of the store, into the store
+// under a single lock. Imported values keep their versions and
+// timestamps. Where a key is already in the store, conflict decides
+// which value is kept; the keys whose current value is kept are
+// removed from values. If replace is true, the keys that aren't in the
+// dump are removed first, and every imported value is taken. It
+// returns the number of keys imported, and how many of them replaced a
+// key that was already in the store. If the result would take the
+// store over its size limit, nothing is changed and errStoreFull is
+// returned.
+func importValues(values map[string]*Value, replace bool, conflict conflictPolicy) (int, int, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	now := time.Now().Unix()
+	skip := map[string]bool{}
+	if !replace {
+		for key, v := range values {
+			cur, ok := store.values[key]
+			if ok && !cur.expired(now) && !conflict(cur, v) {
+				skip[key] = true
+			}
+		}
 	}
 
-	return false
+	total := store.metrics.Bytes
+	if replace {
+		total = 0
+	}
+
+	for key, v := range values {
+		if skip[key] {
+			continue
+		}
+
+		if cur, ok := store.values[key]; ok && !replace {
+			total -= cur.size()
+		}
+		total += v.size()
+	}
+
+	if store.maxBytes > 0 && total > store.metrics.Bytes && total > store.maxBytes {
+		return 0, 0, errStoreFull
+	}
+
+	if replace {
+		for key := range store.values {
+			if _, ok := values[key]; !ok {
+				dropValue(key)
+			}
+		}
+	}
+
+	for key := range skip {
+		delete(values, key)
+	}
+
+	overwritten := 0
+	for key, v := range values {
+		cur, existed := live(key)
+		if existed {
+			overwritten++
+			store.metrics.Bytes -= cur.size()
+			store.metrics.Sizes.add(cur.size(), -1)
+		}
+
+		store.values[key] = v
+		indexExpiry(key, v.ExpiresAt)
+		store.metrics.Bytes += v.size()
+		store.metrics.Sizes.add(v.size(), 1)
+		notify(key, v)
+	}
+
+	store.metrics.Size = len(store.values)
+	store.metrics.LastUpdate = time.Now().Unix()
+	return len(values), overwritten, nil
+}
+
+// incrValue adds delta to the integer stored under key, returning the
+// new value. A missing key is treated as 0. A delta of 0 only reads the
+// value, so it doesn't create a missing key. If the key doesn't hold an
+// integer, errNotInteger is returned, and if the result would overflow,
+// errOverflow is returned.
+func incrValue(key string, delta int64) (int64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var cur int64
+	if v, ok := live(key); ok {
+		var err error
+		cur, err = strconv.ParseInt(v.Value, 10, 64)
+		if err != nil {
+			return 0, errNotInteger
+		}
+	}
+
+	if delta == 0 {
+		return cur, nil
+	}
+
+	if (delta > 0 && cur > math.MaxInt64-delta) || (delta < 0 && cur < math.MinInt64-delta) {
+		return 0, errOverflow
+	}
+
+	cur += delta
+	_, _, err := storeValue(key, strconv.FormatInt(cur, 10), "")
+	if err != nil {
+		return 0, err
+	}
+	return cur, nil
+}
+
+// getOrSet returns the value stored under key if it's present.
+// Otherwise, it stores value under key and returns the new value. The
+// lookup and the write are made under the same lock, so concurrent
+// callers all see the same value. It returns true if the key was
+// created.
+func getOrSet(key, value string) (Value, bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if v, ok := live(key); ok {
+		return v.clone(), false, nil
+	}
+
+	_, _, err := storeValue(key, value, "")
+	if err != nil {
+		return Value{}, false, err
+	}
+
+	return store.values[key].clone(), true, nil
+}
+
+// setField updates a named field of the value stored under key,
+// creating the key if needed. It returns true if the field was
+// changed, and false otherwise. Like setValue, it also returns the
+// previous value of the key, and returns errStoreFull if the change
+// would exceed the store's size limit. Numeric keys can't have
+// fields, so setting one on a numeric key returns errTypeMismatch.
+func setField(key, field, value string) (*Value, bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var prev *Value
+	v, existed := live(key)
+	if existed && v.Type == typeNumber {
+		return nil, false, errTypeMismatch
+	}
+
+	if existed {
+		c := v.clone()
+		prev = &c
+	} else {
+		v = &Value{}
+	}
+	oldSize := v.size()
+
+	if v.Fields == nil {
+		v.Fields = map[string]*Value{}
+	}
+
+	f := v.Fields[field]
+	if f == nil {
+		f = &Value{}
+	}
+
+	if value != f.Value {
+		err := reserve(int64(len(value) - len(f.Value)))
+		if err != nil {
+			return prev, false, err
+		}
+	}
+
+	if f.update(value) {
+		v.Fields[field] = f
+		v.Updated = f.Updated
+		store.values[key] = v
+		resized(existed, oldSize, v)
+		store.metrics.LastUpdate = f.Updated
+		store.metrics.Size = len(store.values)
+		notify(key, v)
+		return prev, true, nil
+	}
+
+	store.metrics.NoopWrites++
+	return prev, false, nil
+}
+
+// setFilename sets the download filename for key, which must already
+// exist. It returns true if the filename was changed.
+func setFilename(key, filename string) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	v, ok := live(key)
+	if !ok || v.Filename == filename {
+		return false
+	}
+
+	v.Filename = filename
+	v.Updated = time.Now().Unix()
+	store.metrics.LastUpdate = v.Updated
+	notify(key, v)
+	return true
+}
+
+// dropValue removes key from the store and updates the metrics,
+// returning the value it held, or nil if the key isn't present. The
+// caller must hold the store lock.
+func dropValue(key string) *Value {
+	v, ok := store.values[key]
+	if !ok {
+		return nil
+	}
+
+	delete(store.values, key)
+	unindexExpiry(key)
+	store.metrics.Bytes -= v.size()
+	store.metrics.Sizes.add(v.size(), -1)
+	store.metrics.LastUpdate = time.Now().Unix()
+	store.metrics.Size = len(store.values)
+	notify(key, nil)
+	return v
+}
+
+// deleteKey removes key from the store. It returns false if the key
+// isn't present.
+func deleteKey(key string) bool {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := live(key); !ok {
+		return false
+	}
+	return dropValue(key) != nil
+}
+
+// popValue removes key from the store, returning the value it held. It
+// mimics getValue, and returns false if the key isn't present.
+func popValue(key string) (Value, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := live(key); !ok {
+		return Value{}, false
+	}
+
+	v := dropValue(key)
+	return v.clone(), true
+}
+
+// writeFileAtomic replaces the file at path with data. The data is
+// written to a temporary file in the same directory, synced, and then
+// renamed over path, so that a crash part way through leaves either
+// the old file or the new one in place, never a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	// Once the file has been renamed, this is a no-op.
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Sync the directory so that the rename itself is durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// diskWriters limits the number of writes of the store to disk that
+// may run at once.
+var diskWriters = struct {
+	// slots holds a token for each write in progress; if it's
+	// nil, the number of writers isn't limited.
+	slots chan struct{}
+
+	// waiting is the number of writes waiting for a slot.
+	waiting int64
+}{}
+
+// setupDiskWriters limits the number of concurrent writes of the store
+// to n; 0 means there's no limit.
+func setupDiskWriters(n int) {
+	if n > 0 {
+		diskWriters.slots = make(chan struct{}, n)
+	}
+}
+
+// acquireDiskWriter waits for a disk writer slot, returning a function
+// that releases it.
+func acquireDiskWriter() func() {
+	if diskWriters.slots == nil {
+		return func() {}
+	}
+
+	atomic.AddInt64(&diskWriters.waiting, 1)
+	diskWriters.slots <- struct{}{}
+	atomic.AddInt64(&diskWriters.waiting, -1)
+
+	return func() { <-diskWriters.slots }
+}
+
+// snapshot returns a copy of the values in the store. The store is
+// only locked while the values are copied, so the (much slower) work
+// of encoding the copy doesn't hold up writes. The snapshot is
+// consistent as of the moment it was taken: changes made while it is
+// being encoded aren't in it, and will be picked up by the next write.
+func snapshot() map[string]Value {
+	values, _ := numberedSnapshot()
+	return values
+}
+
+// written tracks the snapshots written to the store file. Snapshots are
+// numbered in the order they're taken, so that an older snapshot is
+// never written over a newer one.
+var written = struct {
+	lock sync.Mutex
+
+	// taken is the number of the last snapshot taken. It is
+	// incremented while the snapshot holds the store lock, so a
+	// snapshot taken after a change is always numbered higher than
+	// one taken before it.
+	taken uint64
+
+	// last is the number of the snapshot in the store file.
+	last uint64
+}{}
+
+// numberedSnapshot is like snapshot, but also returns the snapshot's
+// number.
+func numberedSnapshot() (map[string]Value, uint64) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	values := make(map[string]Value, len(store.values))
+	for k, v := range store.values {
+		values[k] = v.clone()
+	}
+	return values, atomic.AddUint64(&written.taken, 1)
+}
+
+// exportValues encodes the store to w as a single JSON object, in the
+// same format as the store file. Unlike a snapshot, the values aren't
+// copied: the store is read locked while it's encoded, so writes wait
+// for the export to finish.
+func exportValues(w io.Writer) error {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return json.NewEncoder(w).Encode(store.values)
+}
+
+// writeError records a failed write of the store in the metrics.
+func writeError(err error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.metrics.WriteError = err.Error()
+	store.metrics.WriteErrors++
 }
 
 // writeStore flushes the in-memory key/value pairs to disk. It updates
-// the metrics as appropriate, including any write errors.
+// the metrics as appropriate, including any write errors. The store
+// file is replaced atomically, and rotated afterwards if it has grown
+// past the rotation size. Writes wait for a disk writer slot first.
+//
+// The store is copied under the lock and encoded without it. Writers
+// that overlap could finish in any order, so the file is only replaced
+// if the snapshot is newer than the one already written; otherwise,
+// the newer snapshot already holds every change this one does.
+//
+// If the store is only kept in memory, or the server is read-only,
+// writeStore does nothing.
 func writeStore() error {
-	out, err := json.Marshal(store.values)
+	if !persistent() || readOnly {
+		return nil
+	}
+
+	release := acquireDiskWriter()
+	defer release()
+
+	values, n := numberedSnapshot()
+	out, err := json.Marshal(values)
 	if err != nil {
-		store.metrics.WriteError = err.Error()
+		writeError(err)
 		return err
 	}
 
-	err = ioutil.WriteFile(store.file, out, 0644)
+	written.lock.Lock()
+	if n < written.last {
+		written.lock.Unlock()
+		return nil
+	}
+
+	err = writeFileAtomic(store.file, out)
+	if err == nil {
+		written.last = n
+		err = rotateStore()
+	}
+	written.lock.Unlock()
+
 	if err != nil {
-		store.metrics.WriteError = err.Error()
+		writeError(err)
 		return err
 	}
 
+	store.lock.Lock()
 	store.metrics.LastWrite = time.Now().Unix()
 	store.metrics.WriteError = ""
+	store.lock.Unlock()
 	return nil
 }
 
+// flushStore writes the store to disk regardless of any grace period
+// or pending debounced writes, returning the number of keys written.
+func flushStore() (int, error) {
+	store.lock.RLock()
+	n := len(store.values)
+	store.lock.RUnlock()
+
+	return n, backend.Flush()
+}
+
+// startGrace begins a grace period of length d, during which changes
+// to the store accumulate in memory rather than each being written to
+// disk. The store is written once when the grace period ends, if
+// anything changed.
+func startGrace(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	store.lock.Lock()
+	store.graceUntil = time.Now().Add(d)
+	store.lock.Unlock()
+
+	time.AfterFunc(d, func() {
+		store.lock.Lock()
+		dirty := store.dirty
+		store.dirty = false
+		store.lock.Unlock()
+
+		if dirty {
+			err := backend.Flush()
+			if err != nil {
+				log.Printf("failed to write store after grace period: %v", err)
+			}
+		}
+	})
+}
+
+// flusher coalesces writes of the store to disk.
+var flusher = struct {
+	// interval is the minimum time between writes; if it's
+	// zero, the store is written as part of each change.
+	interval time.Duration
+
+	// wake signals the flushing goroutine that the store is
+	// dirty.
+	wake chan struct{}
+}{
+	wake: make(chan struct{}, 1),
+}
+
+// flush writes the store to disk whenever it's dirty, at most once per
+// interval. A crash loses at most the changes made since the last
+// write, which is one interval's worth.
+func flush() {
+	for range flusher.wake {
+		store.lock.Lock()
+		dirty := store.dirty
+		store.dirty = false
+		store.lock.Unlock()
+
+		if dirty {
+			err := backend.Flush()
+			if err != nil {
+				log.Printf("failed to write store: %v", err)
+			}
+		}
+
+		time.Sleep(flusher.interval)
+	}
+}
+
+// persist writes the store to disk after a change. During the startup
+// grace period, the write is deferred until the period ends. If a
+// flush interval is set, the store is marked dirty and written by the
+// flusher instead; write errors are then logged and reported in the
+// metrics rather than returned.
+func persist() error {
+	store.lock.Lock()
+	if time.Now().Before(store.graceUntil) {
+		store.dirty = true
+		store.lock.Unlock()
+		return nil
+	}
+
+	if flusher.interval > 0 {
+		store.dirty = true
+		store.lock.Unlock()
+
+		select {
+		case flusher.wake <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	store.lock.Unlock()
+
+	return backend.Flush()
+}
+
+// A Diff lists the keys that differ between a dump of the store and
+// the current store. It is exported so that it may be serialised by
+// the JSON package.
+type Diff struct {
+	// Keys in the store that aren't in the dump.
+	Added []string `json:"added"`
+
+	// Keys in the dump that aren't in the store.
+	Removed []string `json:"removed"`
+
+	// Keys whose version or value differs between the dump and
+	// the store.
+	Changed []string `json:"changed"`
+}
+
+// diffStore compares the dump read from r, which is in the same format
+// as the store file, against the current store. The dump is decoded
+// one key at a time, so that the whole dump isn't held in memory, and
+// compared against a copy of the store taken when diffStore is called.
+func diffStore(r io.Reader) (*Diff, error) {
+	store.lock.RLock()
+	now := time.Now().Unix()
+	current := make(map[string]Value, len(store.values))
+	for k, v := range store.values {
+		if !v.expired(now) {
+			current[k] = v.clone()
+		}
+	}
+	store.lock.RUnlock()
+
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return nil, errors.New("dump must be a JSON object")
+	}
+
+	diff := &Diff{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	seen := map[string]bool{}
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := tok.(string)
+
+		var v Value
+		err = dec.Decode(&v)
+		if err != nil {
+			return nil, err
+		}
+
+		seen[key] = true
+		cur, ok := current[key]
+		if !ok {
+			diff.Removed = append(diff.Removed, key)
+		} else if cur.Version != v.Version || cur.Value != v.Value {
+			diff.Changed = append(diff.Changed, key)
+		}
+	}
+
+	if _, err = dec.Token(); err != nil {
+		return nil, err
+	}
+
+	for key := range current {
+		if !seen[key] {
+			diff.Added = append(diff.Added, key)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff, nil
+}
+
+// A Recent records when a key was last updated. It is exported so that
+// it may be serialised by the JSON package.
+type Recent struct {
+	Key     string `json:"key"`
+	Updated int64  `json:"updated"`
+}
+
+// recentKeys returns up to limit keys ordered by the time they were
+// last updated, most recent first if newest is true and oldest first
+// otherwise. Keys updated at the same time are ordered by name. Only
+// the limit entries being returned are kept while the store is
+// scanned.
+func recentKeys(limit int, newest bool) []Recent {
+	before := func(a, b Recent) bool {
+		if a.Updated != b.Updated {
+			return (a.Updated > b.Updated) == newest
+		}
+		return a.Key < b.Key
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	now := time.Now().Unix()
+	recent := make([]Recent, 0, limit+1)
+	for k, v := range store.values {
+		if v.expired(now) {
+			continue
+		}
+
+		r := Recent{Key: k, Updated: v.Updated}
+		i := sort.Search(len(recent), func(i int) bool {
+			return before(r, recent[i])
+		})
+		if i >= limit {
+			continue
+		}
+
+		recent = append(recent, Recent{})
+		copy(recent[i+1:], recent[i:])
+		recent[i] = r
+		if len(recent) > limit {
+			recent = recent[:limit]
+		}
+	}
+
+	return recent
+}
+
+// PrefixStats summarises the keys that share a prefix. It is exported
+// so that it may be serialised by the JSON package.
+type PrefixStats struct {
+	Keys  int   `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// prefixStats groups the keys in the store by the part of the key
+// before the first occurrence of delim, and returns the number of keys
+// and total value size for each prefix. Keys that don't contain delim
+// are grouped under the empty prefix.
+func prefixStats(delim string) map[string]*PrefixStats {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	now := time.Now().Unix()
+	stats := map[string]*PrefixStats{}
+	for k, v := range store.values {
+		if v.expired(now) {
+			continue
+		}
+
+		prefix := ""
+		if i := strings.Index(k, delim); i >= 0 {
+			prefix = k[:i]
+		}
+
+		ps := stats[prefix]
+		if ps == nil {
+			ps = &PrefixStats{}
+			stats[prefix] = ps
+		}
+		ps.Keys++
+		ps.Bytes += v.size()
+	}
+
+	return stats
+}
+
+// debounce tracks the delayed writes for keys that have been changed
+// recently.
+var debounce = struct {
+	lock sync.Mutex
+
+	// quiet is how long a key must go without changes before the
+	// store is written; if it's zero, writes aren't delayed.
+	quiet time.Duration
+
+	// pending maps keys to the timers for their delayed writes.
+	pending map[string]*time.Timer
+}{
+	pending: map[string]*time.Timer{},
+}
+
+// persistKey persists a change to key. If -key-debounce is set, the
+// store isn't written until key has gone that long without changing;
+// each change to key during that time restarts the wait. The change is
+// visible to reads immediately, and only the write to disk is delayed.
+// Errors from a delayed write are logged rather than returned.
+func persistKey(key string) error {
+	if debounce.quiet <= 0 {
+		return persist()
+	}
+
+	debounce.lock.Lock()
+	defer debounce.lock.Unlock()
+
+	if t, ok := debounce.pending[key]; ok {
+		t.Reset(debounce.quiet)
+		return nil
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(debounce.quiet, func() {
+		debounce.lock.Lock()
+		if debounce.pending[key] == t {
+			delete(debounce.pending, key)
+		}
+		debounce.lock.Unlock()
+
+		err := persist()
+		if err != nil {
+			log.Printf("failed to write store after change to %s: %v", logKey(key), err)
+		}
+	})
+	debounce.pending[key] = t
+	return nil
+}
+
+// maxListBytes is the largest list of keys, in bytes, that may be
+// returned; 0 means there's no limit.
+var maxListBytes int
+
+// errListTooLarge is returned when a list of keys would be larger than
+// maxListBytes.
+var errListTooLarge = errors.New("list is too large")
+
+// listSize returns the number of bytes key adds to a JSON list of
+// keys: the key, its quotes and a comma. Escaping isn't counted, so
+// it's a lower bound for keys with characters that need escaping.
+func listSize(key string) int {
+	return len(key) + 3
+}
+
+// listKeys returns the keys in the store that begin with prefix, in
+// sorted order. Expired keys are skipped. If the list would be larger
+// than maxListBytes, errListTooLarge is returned as soon as that's
+// known.
+func listKeys(prefix string) ([]string, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	now := time.Now().Unix()
+	keys := []string{}
+	size := 2
+	for k, v := range store.values {
+		if strings.HasPrefix(k, prefix) && !v.expired(now) {
+			size += listSize(k)
+			if maxListBytes > 0 && size > maxListBytes {
+				return nil, errListTooLarge
+			}
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
 // getValue looks up the key in the store, returning the value if it's
-// present. It mimics the same operation on Go's maps.
+// present. It mimics the same operation on Go's maps. An expired value
+// is treated as absent; it's only read-locked, so concurrent lookups
+// don't block each other, and expired values are left for the sweeper
+// to remove.
 func getValue(key string) (Value, bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	v, ok := store.values[key]
+	if !ok || v.expired(time.Now().Unix()) {
+		return Value{}, false
+	}
+
+	return v.clone(), true
+}
+
+// getValues looks up each of keys in the store, all under the same
+// lock, so that the values are consistent with each other. Every key
+// is present in the result; missing and expired keys map to nil.
+func getValues(keys []string) map[string]*Value {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	now := time.Now().Unix()
+	values := make(map[string]*Value, len(keys))
+	for _, key := range keys {
+		values[key] = nil
+		if v, ok := store.values[key]; ok && !v.expired(now) {
+			c := v.clone()
+			values[key] = &c
+		}
+	}
+	return values
+}
+
+// seedStore merges the key/value pairs read from r into the store. The
+// seed data uses the same format as the store file, except that a
+// plain string may be given in place of a full Value, in which case it
+// is treated as the first version of that key. Every entry is checked
+// by checkValues before any are seeded, and the first bad entry fails
+// the seed. A seeded key doesn't replace an existing key
+// unless it has a higher version. It returns the number of keys that
+// were seeded.
+func seedStore(r io.Reader) (int, error) {
+	var seed = map[string]json.RawMessage{}
+	err := json.NewDecoder(r).Decode(&seed)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().Unix()
+	values := make(map[string]*Value, len(seed))
+	for key, raw := range seed {
+		v := &Value{}
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			v.Value = s
+			v.Version = 1
+			v.Updated = now
+		} else if err = json.Unmarshal(raw, v); err != nil {
+			return 0, fmt.Errorf("key '%s': %v", key, err)
+		}
+		values[key] = v
+	}
+
+	err = checkValues(values)
+	if err != nil {
+		return 0, err
+	}
+
 	store.lock.Lock()
 	defer store.lock.Unlock()
 
-	v, ok := store.values[key]
-	if ok {
-		return *v, ok
+	seeded := 0
+	for key, v := range values {
+		cur, ok := store.values[key]
+		if ok && cur.Version >= v.Version {
+			continue
+		}
+
+		store.values[key] = v
+		indexExpiry(key, v.ExpiresAt)
+		seeded++
 	}
 
-	return Value{}, false
+	return seeded, nil
 }
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// resetStore empties the store and points it at a store file in a
+// temporary directory. Writes go straight to disk rather than through
+// the flusher.
+func resetStore(tb testing.TB) {
+	store.lock.Lock()
+	store.values = map[string]*Value{}
+	store.file = filepath.Join(tb.TempDir(), "store.json")
+	store.metrics = Metrics{}
+	store.lock.Unlock()
+	indexExpiries()
+
+	flusher.interval = 0
+}
+
+// readStoreFile decodes the store file.
+func readStoreFile(tb testing.TB) map[string]*Value {
+	in, err := ioutil.ReadFile(store.file)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	values := map[string]*Value{}
+	err = json.Unmarshal(in, &values)
+	if err != nil {
+		tb.Fatalf("store file is corrupt: %v", err)
+	}
+	return values
+}
+
+// TestConcurrentSetsAndWrites hammers the store with sets while it's
+// being written to disk. Run it with -race: writeStore used to encode
+// the store without holding the lock.
+func TestConcurrentSetsAndWrites(t *testing.T) {
+	resetStore(t)
+
+	const writers, sets = 8, 200
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < sets; j++ {
+				_, _, err := setValue(fmt.Sprintf("key%d", j%10), fmt.Sprintf("%d/%d", i, j))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < sets/10; j++ {
+				if err := writeStore(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	err := writeStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := readStoreFile(t)
+	if len(values) != 10 {
+		t.Fatalf("store file has %d keys, want 10", len(values))
+	}
+
+	for key, v := range values {
+		cur, ok := getValue(key)
+		if !ok || cur.Value != v.Value || cur.Version != v.Version {
+			t.Errorf("%s: store file has %q (version %d), store has %q (version %d)",
+				key, v.Value, v.Version, cur.Value, cur.Version)
+		}
+	}
+}
+
+// BenchmarkConcurrentGets reads keys from many goroutines at once.
+// Reads only take the read lock, so they don't serialise against each
+// other; compare with -cpu 1,4,8.
+func BenchmarkConcurrentGets(b *testing.B) {
+	resetStore(b)
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		setValue(keys[i], "value")
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			getValue(keys[i%len(keys)])
+			i++
+		}
+	})
+}
+
+// BenchmarkWriteStoreUnderWrites writes a large store to disk while
+// other goroutines keep setting keys. The store is only locked while
+// it's copied, so the sets aren't held up for the whole encode.
+func BenchmarkWriteStoreUnderWrites(b *testing.B) {
+	resetStore(b)
+	const n = 100000
+	for i := 0; i < n; i++ {
+		setValue(fmt.Sprintf("key%d", i), fmt.Sprintf("value %d", i))
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				setValue(fmt.Sprintf("key%d", (i*n/4+j)%n), fmt.Sprint(j))
+			}
+		}(i)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := writeStore(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	close(done)
+	wg.Wait()
+}
+
+// TestImportConflict checks which value each conflict policy keeps,
+// including when the values are tied.
+func TestImportConflict(t *testing.T) {
+	existing := Value{Updated: 100, Version: 3, Epoch: 1, Value: "existing"}
+	tests := []struct {
+		policy   string
+		incoming Value
+		want     string
+	}{
+		{"incoming", Value{Updated: 50, Version: 1}, "incoming"},
+		{"incoming", existing, "incoming"},
+		{"existing", Value{Updated: 200, Version: 9, Epoch: 2}, "existing"},
+		{"existing", existing, "existing"},
+		{"version", Value{Updated: 50, Version: 4, Epoch: 1}, "incoming"},
+		{"version", Value{Updated: 200, Version: 2, Epoch: 1}, "existing"},
+		{"version", Value{Updated: 200, Version: 3, Epoch: 1}, "existing"},
+		{"version", Value{Updated: 50, Version: 1, Epoch: 2}, "incoming"},
+		{"version", Value{Updated: 200, Version: 9}, "existing"},
+		{"timestamp", Value{Updated: 101, Version: 1}, "incoming"},
+		{"timestamp", Value{Updated: 99, Version: 9, Epoch: 2}, "existing"},
+		{"timestamp", Value{Updated: 100, Version: 9}, "existing"},
+	}
+
+	for _, tt := range tests {
+		resetStore(t)
+		cur := existing
+		store.values["key"] = &cur
+
+		in := tt.incoming
+		in.Value = "incoming"
+		values := map[string]*Value{"key": &in, "new": {Updated: 1, Version: 1, Value: "new"}}
+		imported, overwritten, err := importValues(values, false, conflictPolicies[tt.policy])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, _ := getValue("key")
+		if v.Value != tt.want {
+			t.Errorf("%s with %+v: kept the %s value, want the %s value", tt.policy, tt.incoming, v.Value, tt.want)
+		}
+
+		wantImported, wantOverwritten := 1, 0
+		if tt.want == "incoming" {
+			wantImported, wantOverwritten = 2, 1
+		}
+		if imported != wantImported || overwritten != wantOverwritten {
+			t.Errorf("%s with %+v: imported %d and overwrote %d, want %d and %d",
+				tt.policy, tt.incoming, imported, overwritten, wantImported, wantOverwritten)
+		}
+
+		if _, ok := getValue("new"); !ok {
+			t.Errorf("%s: new key wasn't imported", tt.policy)
+		}
+	}
+}
+
+// TestMetricsTryLockConcurrent checks that probes for the metrics
+// while the store is write-locked each give up after -metrics-trylock,
+// rather than waiting for each other in turn.
+func TestMetricsTryLockConcurrent(t *testing.T) {
+	resetStore(t)
+	metricsTryLock = 50 * time.Millisecond
+	defer func() { metricsTryLock = 0 }()
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	const probes = 10
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < probes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if m := getMetricsOrStale(); !m.Stale {
+				t.Error("metrics from a locked store aren't marked stale")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if took := time.Since(start); took > 5*metricsTryLock {
+		t.Errorf("%d concurrent probes took %v, want about %v", probes, took, metricsTryLock)
+	}
+}
+
+// TestExpireDue checks that the expiry index finds expired keys, that
+// a limit is honoured, and that the index follows changes to expiry
+// times, deletes and imports.
+func TestExpireDue(t *testing.T) {
+	resetStore(t)
+	past := time.Now().Unix() - 10
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("key%d", i)
+		setValue(key, "value")
+		setExpiry(key, past+int64(i))
+	}
+	setValue("forever", "value")
+
+	setValue("later", "value")
+	setExpiry("later", past+3600)
+	setValue("moved", "value")
+	setExpiry("moved", past+3600)
+	setExpiry("moved", past)
+
+	deleteKey("key4")
+	importValues(map[string]*Value{
+		"imported": {Version: 1, Value: "value", ExpiresAt: past},
+	}, false, conflictPolicies["incoming"])
+
+	if n := expireDue(2); n != 2 {
+		t.Fatalf("expireDue(2) removed %d keys", n)
+	}
+
+	if n := removeExpired(); n != 4 {
+		t.Fatalf("removeExpired removed %d keys, want 4", n)
+	}
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+	for _, key := range []string{"key0", "key1", "key2", "key3", "imported", "moved"} {
+		if _, ok := store.values[key]; ok {
+			t.Errorf("%s wasn't removed", key)
+		}
+	}
+
+	for _, key := range []string{"forever", "later"} {
+		if _, ok := store.values[key]; !ok {
+			t.Errorf("%s was removed", key)
+		}
+	}
+
+	if len(expiries.heap) != 1 || len(expiries.entries) != 1 || expiries.heap[0].key != "later" {
+		t.Errorf("expiry index holds %d entries, want only later", len(expiries.heap))
+	}
+}
+
+// TestCheckValues checks that everything the server can write passes
+// the checks made on imports, and that bad entries don't.
+func TestCheckValues(t *testing.T) {
+	resetStore(t)
+	setValue("plain", "value")
+	setField("fields", "f", "value")
+	setExpiry("plain", time.Now().Unix()+60)
+
+	values := map[string]*Value{}
+	for key, v := range snapshot() {
+		v := v
+		values[key] = &v
+	}
+
+	if err := checkValues(values); err != nil {
+		t.Errorf("the server's own store fails the import checks: %v", err)
+	}
+
+	bad := map[string]map[string]*Value{
+		"reserved key":       {"_metrics": {Version: 1, Value: "x"}},
+		"empty key":          {"": {Version: 1, Value: "x"}},
+		"null value":         {"k": nil},
+		"negative version":   {"k": {Version: -5}},
+		"unwritten value":    {"k": {Value: "x"}},
+		"non-numeric number": {"k": {Version: 1, Value: "abc", Type: typeNumber}},
+		"null field":         {"k": {Version: 1, Fields: map[string]*Value{"f": nil}}},
+		"numeric with fields": {"k": {Version: 1, Value: "1", Type: typeNumber,
+			Fields: map[string]*Value{"f": {Version: 1, Value: "x"}}}},
+		"nested field": {"k": {Version: 1, Fields: map[string]*Value{
+			"f": {Version: 1, Fields: map[string]*Value{"g": {Version: 1}}},
+		}}},
+	}
+	for name, values := range bad {
+		if err := checkValues(values); err == nil {
+			t.Errorf("%s passes the import checks", name)
+		}
+	}
+}
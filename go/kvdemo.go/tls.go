@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// tlsVersions maps the names accepted by -tls-min-version to TLS
+// versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsOptions holds the -tls-min-version and -tls-ciphers flags.
+var tlsOptions = struct {
+	minVersion string
+	ciphers    string
+}{
+	minVersion: "1.2",
+}
+
+// parseCipherSuites returns the IDs of the comma-separated cipher
+// suites in names, which are given by their standard names, such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Only the suites Go considers
+// secure are accepted. An empty list leaves the choice to Go.
+func parseCipherSuites(names string) ([]uint16, error) {
+	if names == "" {
+		return nil, nil
+	}
+
+	known := map[string]uint16{}
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// certs holds the server's certificate, which is reloaded from its
+// files on SIGHUP.
+var certs = struct {
+	lock sync.RWMutex
+
+	certFile, keyFile string
+	cert              *tls.Certificate
+}{}
+
+// loadCertificate reads the server's certificate and key from their
+// files. If they can't be loaded, the current certificate is kept.
+func loadCertificate() error {
+	cert, err := tls.LoadX509KeyPair(certs.certFile, certs.keyFile)
+	if err != nil {
+		return err
+	}
+
+	certs.lock.Lock()
+	defer certs.lock.Unlock()
+
+	certs.cert = &cert
+	return nil
+}
+
+// getCertificate returns the certificate to present in a handshake.
+// A connection keeps the certificate it was set up with, so a reload
+// only affects new connections.
+func getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs.lock.RLock()
+	defer certs.lock.RUnlock()
+
+	return certs.cert, nil
+}
+
+// reloadOnHangup reloads the server's certificate each time the
+// process receives SIGHUP, so that a renewed certificate can be put in
+// place without restarting the server.
+func reloadOnHangup() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	for range sigs {
+		err := loadCertificate()
+		if err != nil {
+			log.Printf("failed to reload certificate, keeping the current one: %v", err)
+			continue
+		}
+		log.Printf("reloaded certificate from %s", certs.certFile)
+	}
+}
+
+// clientCA is the file holding the CA certificates that client
+// certificates must be signed by; if it's empty, clients aren't asked
+// for certificates.
+var clientCA string
+
+// clientCAs holds the certificates loaded from clientCA.
+var clientCAs *x509.CertPool
+
+// h2Cipher reports whether ciphers includes a suite that HTTP/2
+// requires.
+func h2Cipher(ciphers []uint16) bool {
+	for _, id := range ciphers {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+// serverTLSConfig returns the TLS configuration for the server, which
+// presents the certificate in certFile with the key in keyFile, and
+// only allows the versions and cipher suites given by tlsOptions. The
+// cipher suites don't apply to TLS 1.3, whose suites can't be
+// configured. If -client-ca is set, clients are asked for a
+// certificate. It's verified against the CAs in that file by the
+// handler rather than during the handshake, so that a client without a
+// valid certificate gets an HTTP response saying why.
+func serverTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	certs.certFile, certs.keyFile = certFile, keyFile
+	err := loadCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	minVersion, ok := tlsVersions[tlsOptions.minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %s; use 1.0, 1.1, 1.2 or 1.3", tlsOptions.minVersion)
+	}
+
+	ciphers, err := parseCipherSuites(tlsOptions.ciphers)
+	if err != nil {
+		return nil, err
+	}
+
+	// HTTP/2 won't start without one of these.
+	if len(ciphers) > 0 && !h2Cipher(ciphers) {
+		return nil, errors.New("-tls-ciphers must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, which HTTP/2 requires")
+	}
+
+	cfg := &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   ciphers,
+	}
+	if clientCA == "" {
+		return cfg, nil
+	}
+
+	pem, err := ioutil.ReadFile(clientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCA)
+	}
+
+	clientCAs = pool
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.RequestClientCert
+	return cfg, nil
+}
+
+// certVerified reports whether req may proceed: if -client-ca is set,
+// it must have been made over TLS with a client certificate signed by
+// one of the CAs.
+func certVerified(req *http.Request) bool {
+	if clientCA == "" {
+		return true
+	}
+
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return false
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         clientCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range req.TLS.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := req.TLS.PeerCertificates[0].Verify(opts)
+	return err == nil
+}
+
+// certRequired returns a response for a request without a valid client
+// certificate.
+func certRequired() *Response {
+	return &Response{
+		Status: http.StatusUnauthorized,
+		Data:   "a client certificate signed by a trusted CA is required",
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for name, and its
+// key, to certFile and keyFile. It returns the DER-encoded certificate.
+func writeTestCert(t *testing.T, name, certFile, keyFile string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// TestCertificateReload checks that reloading the certificate changes
+// the one presented to new connections, while a connection made before
+// the reload keeps the old one.
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	oldCert := writeTestCert(t, "old.example", certFile, keyFile)
+
+	saved := certs.cert
+	defer func() { certs.cert = saved }()
+	certs.certFile, certs.keyFile = certFile, keyFile
+	if err := loadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	srv.TLS = &tls.Config{GetCertificate: getCertificate}
+	srv.StartTLS()
+	defer srv.Close()
+
+	// peerCert returns the certificate the server presents on conn.
+	peerCert := func(conn *tls.Conn) []byte {
+		return conn.ConnectionState().PeerCertificates[0].Raw
+	}
+
+	// StartTLS adds httptest's own certificate to the config, which
+	// is only passed over for GetCertificate when the client sends a
+	// server name.
+	dial := func() *tls.Conn {
+		cfg := &tls.Config{ServerName: "localhost", InsecureSkipVerify: true}
+		conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	before := dial()
+	defer before.Close()
+	if string(peerCert(before)) != string(oldCert) {
+		t.Fatal("server didn't present the loaded certificate")
+	}
+
+	newCert := writeTestCert(t, "new.example", certFile, keyFile)
+	if err := loadCertificate(); err != nil {
+		t.Fatal(err)
+	}
+
+	after := dial()
+	defer after.Close()
+	if string(peerCert(after)) != string(newCert) {
+		t.Error("a new connection didn't get the reloaded certificate")
+	}
+
+	if string(peerCert(before)) != string(oldCert) {
+		t.Error("the connection made before the reload changed certificates")
+	}
+
+	// A failed reload keeps the current certificate.
+	if err := ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadCertificate(); err == nil {
+		t.Fatal("loading a broken key succeeded")
+	}
+
+	last := dial()
+	defer last.Close()
+	if string(peerCert(last)) != string(newCert) {
+		t.Error("a failed reload replaced the certificate")
+	}
+}
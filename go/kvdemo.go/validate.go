@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// validator controls the external validation of values before they are
+// written to the store.
+var validator = struct {
+	// cmd is a shell command run for each write; if it's empty,
+	// values aren't validated.
+	cmd string
+
+	// timeout bounds how long cmd may run.
+	timeout time.Duration
+}{
+	timeout: 5 * time.Second,
+}
+
+// maxKeyLength is the longest key, in bytes, that may be written; 0
+// means there's no limit.
+var maxKeyLength = 1024
+
+// validateKey checks that key may be written to the store. A key must
+// not be empty, must not begin with an underscore, which is reserved
+// for the server's endpoints, and must not contain control characters.
+// It may be at most maxKeyLength bytes long.
+func validateKey(key string) error {
+	if key == "" {
+		return errors.New("keys may not be empty")
+	}
+
+	if strings.HasPrefix(key, "_") {
+		return errors.New("keys beginning with an underscore are reserved")
+	}
+
+	if maxKeyLength > 0 && len(key) > maxKeyLength {
+		return fmt.Errorf("keys may be at most %d bytes", maxKeyLength)
+	}
+
+	for _, r := range key {
+		if r < 0x20 || r == 0x7f {
+			return errors.New("keys may not contain control characters")
+		}
+	}
+
+	return nil
+}
+
+// validateValue runs the validation command, if one is configured, to
+// check value before it's stored under key. The command is run with
+// the shell and is given a JSON object containing the key and value on
+// its standard input. If the command exits with a non-zero status or
+// doesn't finish before the timeout, the write is rejected and the
+// returned error contains the command's standard error.
+func validateValue(key, value string) error {
+	if validator.cmd == "" {
+		return nil
+	}
+
+	in, err := json.Marshal(map[string]string{
+		"key":   key,
+		"value": value,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), validator.timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", validator.cmd)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stderr = &stderr
+
+	// Children of the shell may hold stderr open after the shell
+	// itself has been killed; don't wait on them.
+	cmd.WaitDelay = 100 * time.Millisecond
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New("validation timed out")
+	}
+
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = "validation failed: " + err.Error()
+		}
+		return errors.New(msg)
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Change describes a single change made to the store. It is exported
+// so that it may be serialised by the JSON package.
+type Change struct {
+	Op    string `json:"op"` // "set" or "delete"
+	Key   string `json:"key"`
+	Value *Value `json:"value,omitempty"` // The new value, for sets.
+	Time  int64  `json:"time"`
+}
+
+// watchBuffer is the number of changes that may be queued for a
+// subscriber before it's considered too slow and dropped.
+const watchBuffer = 64
+
+// watchers tracks the subscribers to changes in the store, along with
+// the key prefix each one is interested in.
+var watchers = struct {
+	lock sync.Mutex
+	subs map[chan Change]string
+}{
+	subs: map[chan Change]string{},
+}
+
+// subscribe registers for changes to keys beginning with prefix. The
+// returned channel is closed if the subscriber falls too far behind.
+func subscribe(prefix string) chan Change {
+	ch := make(chan Change, watchBuffer)
+
+	watchers.lock.Lock()
+	watchers.subs[ch] = prefix
+	watchers.lock.Unlock()
+
+	return ch
+}
+
+// unsubscribe stops the delivery of changes to ch.
+func unsubscribe(ch chan Change) {
+	watchers.lock.Lock()
+	defer watchers.lock.Unlock()
+
+	if _, ok := watchers.subs[ch]; ok {
+		delete(watchers.subs, ch)
+		close(ch)
+	}
+}
+
+// unsubscribeAll stops the delivery of changes to every subscriber,
+// ending their streams.
+func unsubscribeAll() {
+	watchers.lock.Lock()
+	defer watchers.lock.Unlock()
+
+	for ch := range watchers.subs {
+		delete(watchers.subs, ch)
+		close(ch)
+	}
+}
+
+// notify delivers a change to key to the interested subscribers. v is
+// the new value, or nil if the key was deleted. notify is called with
+// the store lock held so that changes are delivered in the order they
+// were made; it never blocks, and instead drops any subscriber whose
+// buffer is full.
+func notify(key string, v *Value) {
+	watchers.lock.Lock()
+	defer watchers.lock.Unlock()
+
+	if len(watchers.subs) == 0 {
+		return
+	}
+
+	c := Change{Op: "delete", Key: key, Time: time.Now().Unix()}
+	if v != nil {
+		copied := v.clone().public()
+		c.Op = "set"
+		c.Value = &copied
+	}
+
+	for ch, prefix := range watchers.subs {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		select {
+		case ch <- c:
+		default:
+			delete(watchers.subs, ch)
+			close(ch)
+		}
+	}
+}